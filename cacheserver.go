@@ -2,13 +2,16 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/zeneli/cacheserver/rangecache"
 )
@@ -23,113 +26,279 @@ type entry struct {
 	ready chan struct{} // close when value is ready
 }
 
+// dupKey identifies an in-flight fetch. It includes the source URL so
+// that two origins with overlapping byte ranges don't collide and
+// suppress each other.
+type dupKey struct {
+	url      string
+	keyrange rangecache.Keyrange
+}
+
 // CacheServer implements a caching server.
 type CacheServer struct {
-	mu    sync.Mutex // guards cache
-	cache *rangecache.RangeCache
-	dup   map[rangecache.Keyrange]*entry // cache of work in progress
+	mu sync.Mutex // guards caches, dup and peers
+
+	nbytes int64 // per-origin byte limit, forwarded to each origin's own RangeCache
+	opts   []rangecache.Option
+	caches map[string]*rangecache.RangeCache // source URL -> that origin's own cache; see cacheFor
+
+	dup     map[dupKey]*entry // cache of work in progress
+	peers   PeerPicker        // nil until SetPeers is called
+	origins *OriginRegistry   // allow-list + probe cache; nil until SetOrigins is called
 }
 
-// NewCache returns an initialized CacheServer.
-func NewCacheServer(nbytes int64) *CacheServer {
+// NewCacheServer returns an initialized CacheServer. opts, if given, are
+// forwarded to each origin's rangecache.NewRangeCache, e.g. to pick a
+// non-default eviction policy.
+func NewCacheServer(nbytes int64, opts ...rangecache.Option) *CacheServer {
 	return &CacheServer{
-		cache: rangecache.NewRangeCache(nbytes),
-		dup:   make(map[rangecache.Keyrange]*entry),
+		nbytes: nbytes,
+		opts:   opts,
+		caches: make(map[string]*rangecache.RangeCache),
+		dup:    make(map[dupKey]*entry),
 	}
 }
 
-// ServeHTTP implements the HTTP user interface.
-// Its responsible for parsing query paramters;
-// a source url, start byte, and optional end byte.
-// Ensuring the associated url supports range requests.
-// And serve the requested range in a concurrently safe manner.
+// cacheFor returns url's own RangeCache, creating it on first use. Every
+// origin gets an independent cache so that two origins serving
+// overlapping (or identical) byte ranges can never collide, and
+// rangecache.Stitch can never splice segments from different origins
+// together. Callers must hold cs.mu.
+func (cs *CacheServer) cacheFor(url string) *rangecache.RangeCache {
+	rc, ok := cs.caches[url]
+	if !ok {
+		rc = rangecache.NewRangeCache(cs.nbytes, cs.opts...)
+		cs.caches[url] = rc
+	}
+	return rc
+}
+
+// SetPeers registers the PeerPicker used to locate which pool member
+// owns a given keyrange. Until SetPeers is called, GetRangeDupSup always
+// performs the origin fetch itself.
+func (cs *CacheServer) SetPeers(pp PeerPicker) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.peers = pp
+}
+
+// SetOrigins registers the OriginRegistry ServeHTTP and ServeRangeStream
+// validate source URLs against. Until SetOrigins is called, every
+// request is rejected with 400, since an unconfigured server has no
+// origins it's allowed to fetch from.
+func (cs *CacheServer) SetOrigins(origins *OriginRegistry) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.origins = origins
+}
+
+// ServeHTTP implements the HTTP user interface. It parses the query
+// parameters (a source url, start byte, and optional end byte),
+// validates url against the registered OriginRegistry, and serves the
+// requested range in a concurrently safe manner.
 func (cs *CacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// use VIDEOURL for testing
-	sourceURL := VIMEOURL
-	_, start, end, err := processRequiredQueryParams(r.URL.String())
+	cs.mu.Lock()
+	origins := cs.origins
+	cs.mu.Unlock()
+
+	sourceURL, start, end, err := processRequiredQueryParams(r.URL.String())
 	if err != nil {
-		fmt.Fprintln(w, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	contentLength, ok := checkHTTPRangeSupportAndLength(sourceURL)
-	if !ok {
-		fmt.Fprintln(w, "%s does not supports HTPP byte ranges", sourceURL)
+	if origins == nil || !origins.Validate(sourceURL) {
+		http.Error(w, fmt.Sprintf("url %q is not an allowed origin", sourceURL), http.StatusBadRequest)
+		return
+	}
+
+	contentLength, rangesOK, err := origins.Probe(sourceURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("probing %s: %v", sourceURL, err), http.StatusBadGateway)
+		return
+	}
+	if !rangesOK {
+		http.Error(w, fmt.Sprintf("%s does not support HTTP byte ranges", sourceURL), http.StatusBadGateway)
+		return
+	}
+	if start >= contentLength {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentLength))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
+	if end > contentLength-1 { // clamp to the last valid byte offset
+		end = contentLength - 1
+	}
+
+	keyrange := rangecache.Keyrange{Start: int(start), End: int(end)}
 
-	if end > contentLength { // check end bound
-		end = contentLength
+	etag := rangeETag(sourceURL, keyrange)
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
-	body, ok := cs.GetRangeDupSup(sourceURL, rangecache.Keyrange{int(start), int(end)})
+	condHeaders := make(http.Header)
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		condHeaders.Set("If-None-Match", v)
+	}
+	if v := r.Header.Get("If-Modified-Since"); v != "" {
+		condHeaders.Set("If-Modified-Since", v)
+	}
+
+	body, ok := cs.GetRangeDupSup(sourceURL, keyrange, condHeaders)
 	if !ok {
-		fmt.Fprintln(w, "Couldn't get that")
+		http.Error(w, fmt.Sprintf("fetching %s: upstream error", sourceURL), http.StatusBadGateway)
+		return
 	}
-	w.Header().Add("Content-Type", "video/mp4")
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", keyrange.Start, keyrange.End, contentLength))
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusPartialContent)
 	w.Write(body)
-	return
 }
 
-// add is a wrapper around the caches add that is concurrency-safe.
-func (cs *CacheServer) add(keyrange rangecache.Keyrange, body interface{}) {
+// rangeETag derives a sensible ETag for (sourceURL, keyrange): weak,
+// since it's a function of the requested range rather than a hash of
+// the bytes themselves.
+func rangeETag(sourceURL string, keyrange rangecache.Keyrange) string {
+	return fmt.Sprintf(`W/"%x-%x-%x"`, hashString(sourceURL), keyrange.Start, keyrange.End)
+}
+
+// hashString is a small FNV-1a hash, good enough to keep rangeETag
+// compact without pulling in crypto/sha256 for a cache-freshness token.
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// add is a wrapper around url's cache's add that is concurrency-safe.
+func (cs *CacheServer) add(url string, keyrange rangecache.Keyrange, body interface{}) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rc := cs.cacheFor(url)
+	switch body.(type) {
+	case []int:
+		rc.Add(keyrange, body.([]int))
+	case []byte:
+		rc.Add(keyrange, body.([]byte))
+	}
+}
+
+// addSecondary is like add, but for a body this instance fetched from a
+// peer rather than the origin: it's stored via rc.AddSecondary so an
+// eviction policy that supports it (see rangecache.SecondaryAdmitter)
+// can treat it as a lower-priority "hot" entry rather than on equal
+// footing with an origin fetch.
+func (cs *CacheServer) addSecondary(url string, keyrange rangecache.Keyrange, body interface{}) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
+	rc := cs.cacheFor(url)
 	switch body.(type) {
 	case []int:
-		cs.cache.Add(keyrange, body.([]int))
+		rc.AddSecondary(keyrange, body.([]int))
 	case []byte:
-		cs.cache.Add(keyrange, body.([]byte))
+		rc.AddSecondary(keyrange, body.([]byte))
 	}
 }
 
-// get is a wrapper around the caches get that is concurrency-safe.
-func (cs *CacheServer) get(keyrange rangecache.Keyrange) (interface{}, bool) {
+// get is a wrapper around url's cache's get that is concurrency-safe.
+func (cs *CacheServer) get(url string, keyrange rangecache.Keyrange) (interface{}, bool) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return cs.cache.Get(keyrange)
+	return cs.cacheFor(url).Get(keyrange)
 }
 
-// GetRangeDupSup checks the cache for keyrange, otherwise does an HTTP range request.
-// Avoiding redundant keyrange requests by duplicate suppression.
-// GetRangeDupSup is concurrency-safe.
-func (cs *CacheServer) GetRangeDupSup(url string, keyrange rangecache.Keyrange) ([]byte, bool) {
+// GetRangeDupSup checks the cache for keyrange, otherwise fetches it -
+// from a peer if keyrange belongs to one, or from the origin otherwise -
+// and avoids redundant keyrange requests by duplicate suppression.
+// condHeaders, if non-nil, is propagated to the origin request when a
+// fetch actually happens (it has no effect on a cache hit or a peer
+// fetch). GetRangeDupSup is concurrency-safe.
+func (cs *CacheServer) GetRangeDupSup(url string, keyrange rangecache.Keyrange, condHeaders http.Header) ([]byte, bool) {
+	if v, ok := cs.get(url, keyrange); ok { // cache hit; nothing to suppress
+		return v.([]byte), true
+	}
+
 	cs.mu.Lock()
-	rangeHeader := fmt.Sprintf("bytes=%d-%d", keyrange.Start, keyrange.End)
-	e := cs.dup[keyrange]
-	if e == nil { // first request for this keyrange
+	dk := dupKey{url, keyrange}
+	peers := cs.peers
+	origins := cs.origins
+	e := cs.dup[dk]
+	if e == nil { // first request for this (url, keyrange)
 		e = &entry{ready: make(chan struct{})}
-		cs.dup[keyrange] = e // allocate entry; force other goroutines to wait
+		cs.dup[dk] = e // allocate entry; force other goroutines to wait
 		cs.mu.Unlock()
 
 		// do work
-		body, err := httpGetRangeRequest(url, rangeHeader)
+		var body []byte
+		var err error
+		fromPeer := false
+		if peer, ok := peerFor(peers, url, keyrange); ok {
+			fromPeer = true
+			body, err = peer.Get(url, keyrange)
+		} else {
+			rangeHeader := fmt.Sprintf("bytes=%d-%d", keyrange.Start, keyrange.End)
+			timeout := defaultOriginTimeout
+			if origins != nil {
+				timeout = origins.Timeout(url)
+			}
+			body, err = httpGetRangeRequest(url, rangeHeader, condHeaders, timeout)
+		}
 		if err != nil {
+			cs.mu.Lock()
+			delete(cs.dup, dk)
+			cs.mu.Unlock()
+			close(e.ready)
 			return nil, false
 		}
-		cs.add(keyrange, body)
+		if fromPeer { // cache a peer-forwarded range only as a lower-priority "hot" entry
+			cs.addSecondary(url, keyrange, body)
+		} else {
+			cs.add(url, keyrange, body)
+		}
 
-		// Broadcast to waiting goroutines the work is done.
+		// Broadcast to waiting goroutines the work is done, and return
+		// body directly rather than reading it back out of the cache:
+		// that read would Touch the entry, promoting a secondary entry
+		// to the same standing as a primary one the moment it's cached.
 		close(e.ready)
-	} else { // repeated range request; suppress duplicate
-		cs.mu.Unlock()
-		<-e.ready // Wait for ready; other goroutine is handling work.
+		return body, true
 	}
+	// repeated (url, keyrange) request; suppress duplicate
+	cs.mu.Unlock()
+	<-e.ready // Wait for ready; other goroutine is handling work.
 
-	v, ok := cs.get(keyrange)
+	v, ok := cs.get(url, keyrange)
 	if !ok {
 		return nil, false
 	}
-	ioutil.WriteFile(rangeHeader+".mp4", v.([]byte), 0666)
 	return v.([]byte), true
 }
 
+// peerFor asks pp which peer owns (url, keyrange). It returns false if
+// pp is nil, no peer is registered for the key, or the key belongs to
+// this instance.
+func peerFor(pp PeerPicker, url string, keyrange rangecache.Keyrange) (PeerGetter, bool) {
+	if pp == nil {
+		return nil, false
+	}
+	return pp.PickPeer(encodeKey(url, keyrange))
+}
+
 // GetRange checks the cache for keyrange, otherwise does an HTTP range request.
 // GetRange is concurrency-safe.
 func (cs *CacheServer) GetRange(url string, keyrange rangecache.Keyrange) ([]byte, error) {
 	//timeStart := time.Now()
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", keyrange.Start, keyrange.End)
 
-	v, ok := cs.get(keyrange)
+	v, ok := cs.get(url, keyrange)
 	if ok { // cache hit
 		body := v.([]byte)
 		//ioutil.WriteFile(rangeHeader+".mp4", v.([]byte), 0x777) // write to file
@@ -138,33 +307,38 @@ func (cs *CacheServer) GetRange(url string, keyrange rangecache.Keyrange) ([]byt
 	}
 
 	// cache miss; make request
-	body, err := httpGetRangeRequest(url, rangeHeader)
+	body, err := httpGetRangeRequest(url, rangeHeader, nil, defaultOriginTimeout)
 	if err != nil {
 		return nil, err
 	}
-	cs.add(keyrange, body)
+	cs.add(url, keyrange, body)
 	// ioutil.WriteFile(rangeHeader+".mp4", []byte(string(body)), 0666)
 	// log.Printf("cache miss: %s, GET: %s\n", time.Since(timeStart), rangeHeader)
 	return body, nil
 }
 
-// httpGetRangeRequest is a helper function that creates an HTTP client,
-// adds the range header, and returns the request body data.
-func httpGetRangeRequest(url, rangeHeader string) ([]byte, error) {
-	client := &http.Client{}
+// httpGetRangeRequest creates an HTTP client bounded by timeout, adds
+// the range header plus any extra (e.g. conditional) headers, and
+// returns the response body.
+func httpGetRangeRequest(url, rangeHeader string, extra http.Header, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Range", rangeHeader)
+	req.Header.Set("Range", rangeHeader)
+	for k, vs := range extra {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
 
 	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
 }
 
 // processRequiredQueryParams checks the given query URL and returns the query params
@@ -198,37 +372,72 @@ func processRequiredQueryParams(queryURL string) (string, int64, int64, error) {
 		return "", 0, 0, err
 	}
 
+	if starti < 0 {
+		return "", 0, 0, errors.New("query parameter start must not be negative")
+	}
+	if endi < starti {
+		return "", 0, 0, errors.New("query parameter end must not be before start")
+	}
+
 	return sourceURL, int64(starti), int64(endi), nil
 }
 
-// checkHTTPRangeSupportAndLength does an HTTP head request to the sourceURL and checks
-// if it supports HTTP byte ranges. Also returns the content length for bounds checking.
-func checkHTTPRangeSupportAndLength(sourceURL string) (contentLength int64, ok bool) {
-	client := &http.Client{}
-	resp, err := client.Head(sourceURL)
-	if err != nil {
-		return 0, false
-	}
-	for _, rangeSupport := range resp.Header["Accept-Ranges"] {
-		if rangeSupport == "bytes" { // supports HTTP byte ranges
-			// HTTP header for Content-Length
-			contentLength, err := strconv.Atoi(resp.Header["Content-Length"][0])
-			if err != nil {
-				return 0, false
-			}
-			return int64(contentLength), true
-		} else {
-			return 0, false
-		}
-	} // fell through
-	return 0, false
+// evictionPolicyFlag maps an -eviction flag value to the rangecache
+// Option that installs the matching EvictionPolicy. The sampled-LFU and
+// S3-FIFO policies are sized off how many chunkSize sub-chunks fit in
+// nbytesMax, a reasonable estimate of how many distinct ranges the
+// cache holds at once.
+func evictionPolicyFlag(name string) (rangecache.Option, error) {
+	capacity := int(nbytesMax / chunkSize)
+	switch name {
+	case "lru":
+		return rangecache.WithEvictionPolicy(rangecache.NewLRUPolicy()), nil
+	case "lfu":
+		return rangecache.WithEvictionPolicy(rangecache.NewSampledLFUPolicy(capacity)), nil
+	case "s3fifo":
+		return rangecache.WithEvictionPolicy(rangecache.NewS3FIFOPolicy(capacity)), nil
+	default:
+		return nil, fmt.Errorf("unknown -eviction policy %q: want lru, lfu, or s3fifo", name)
+	}
 }
 
 func main() {
-	cacheserver := NewCacheServer(nbytesMax) // 64 MB cache server
+	addr := flag.String("addr", ":8080", "address to serve cache requests on")
+	self := flag.String("self", "http://localhost:8080", "this instance's base URL, as seen by peers")
+	peers := flag.String("peers", "", "comma-separated base URLs of every instance in the pool, including self")
+	eviction := flag.String("eviction", "lru", "eviction policy for the range cache: lru, lfu, or s3fifo")
+	origins := flag.String("origins", VIMEOURL, "comma-separated URL prefixes this server is allowed to fetch from")
+	originTimeout := flag.Duration("origin-timeout", defaultOriginTimeout, "HTTP timeout for requests to an allowed origin")
+	flag.Parse()
+
+	policy, err := evictionPolicyFlag(*eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheserver := NewCacheServer(nbytesMax, policy) // 64 MB cache server
+
+	registry := NewOriginRegistry()
+	for _, prefix := range strings.Split(*origins, ",") {
+		registry.Allow(prefix, *originTimeout)
+	}
+	cacheserver.SetOrigins(registry)
+
+	pool := NewHTTPPool(*self)
+	pool.SetLocal(cacheserver)
+	if *peers != "" {
+		pool.Set(strings.Split(*peers, ",")...)
+		cacheserver.SetPeers(pool)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(peerPath, pool)
+	mux.HandleFunc("/stream", cacheserver.ServeRangeStream)
+	mux.Handle("/", cacheserver)
+
 	s := &http.Server{
-		Addr:    ":8080",
-		Handler: cacheserver,
+		Addr:    *addr,
+		Handler: mux,
 	}
 	log.Fatal(s.ListenAndServe())
 }
@@ -62,7 +62,7 @@ func testSequentialReal(t *testing.T, cs *CacheServer) {
 func testSequentialRealDupSup(t *testing.T, cs *CacheServer) {
 	for kr := range incomingRangeRequests() {
 		start := time.Now()
-		body, _ := cs.GetRangeDupSup(VIMEOURL, kr)
+		body, _ := cs.GetRangeDupSup(VIMEOURL, kr, nil)
 		log.Printf("time: %s: GetRange(%v), %d bytes", time.Since(start), kr, len(body))
 	}
 }
@@ -93,7 +93,7 @@ func testConcurrentRealDupSup(t *testing.T, cs *CacheServer) {
 		go func(keyrange rangecache.Keyrange) {
 			defer n.Done() // defer done
 			start := time.Now()
-			body, ok := cs.GetRangeDupSup(VIMEOURL, keyrange)
+			body, ok := cs.GetRangeDupSup(VIMEOURL, keyrange, nil)
 			if !ok {
 				return
 			}
@@ -146,7 +146,7 @@ func testConcurrentFakeDupSupression(t *testing.T, cs *CacheServer) {
 // by calling the generateValue helper.
 func getRangeValue(cs *CacheServer, keyrange rangecache.Keyrange) []int {
 	timeStart := time.Now()
-	v, ok := cs.get(keyrange)
+	v, ok := cs.get(VIMEOURL, keyrange)
 	if ok { // cache hit
 		body := v.([]int)
 		log.Printf("cache hit: %s, GET: %v\n", time.Since(timeStart), keyrange)
@@ -155,7 +155,7 @@ func getRangeValue(cs *CacheServer, keyrange rangecache.Keyrange) []int {
 
 	// cache miss; make request
 	body := generateValue(keyrange)
-	cs.add(keyrange, body)
+	cs.add(VIMEOURL, keyrange, body)
 	log.Printf("cache miss: %s, GET: %v\n", time.Since(timeStart), keyrange)
 	return body
 }
@@ -164,25 +164,25 @@ func getRangeValue(cs *CacheServer, keyrange rangecache.Keyrange) []int {
 // by calling the generateValue helper.
 func getRangeValueDupSup(cs *CacheServer, keyrange rangecache.Keyrange) []int {
 	cs.mu.Lock()
-	e := cs.dup[keyrange]
+	dk := dupKey{VIMEOURL, keyrange}
+	e := cs.dup[dk]
 	var body []int
 	if e == nil { // first request for this range
 		log.Printf("first request: %v\n", keyrange)
 		e = &entry{ready: make(chan struct{})}
-		cs.dup[keyrange] = e
+		cs.dup[dk] = e
 		cs.mu.Unlock()
 
 		// do work
 		body = generateValue(keyrange)
-		cs.add(keyrange, body)
-		//cs.cache.Add(keyrange, body)
+		cs.add(VIMEOURL, keyrange, body)
 		close(e.ready)
 	} else { // repeated range request
 		log.Printf("repeated request: %v\n", keyrange)
 		cs.mu.Unlock()
 		<-e.ready // wait for ready
 	}
-	value, _ := cs.get(keyrange)
+	value, _ := cs.get(VIMEOURL, keyrange)
 	return value.([]int)
 }
 
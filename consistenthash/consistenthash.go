@@ -0,0 +1,73 @@
+// Package consistenthash implements a Ketama-style consistent hash ring,
+// used to assign cache keys to peers in a pool.
+package consistenthash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Hash maps bytes to a uint32.
+type Hash func(data []byte) uint32
+
+// Map holds the sorted hash ring and the peer each point on the ring
+// belongs to. Map is not safe for concurrent use; callers must
+// synchronize their own access.
+type Map struct {
+	hash     Hash
+	replicas int
+	keys     []int // sorted ring, hashes of virtual nodes
+	hashMap  map[int]string
+}
+
+// New creates a Map. replicas is the number of virtual nodes per peer
+// added to the ring; more replicas spread load more evenly across peers
+// at the cost of a larger ring to search. fn defaults to crc32.ChecksumIEEE
+// when nil.
+func New(replicas int, fn Hash) *Map {
+	m := &Map{
+		replicas: replicas,
+		hash:     fn,
+		hashMap:  make(map[int]string),
+	}
+	if m.hash == nil {
+		m.hash = crc32.ChecksumIEEE
+	}
+	return m
+}
+
+// IsEmpty returns true if there are no peers on the ring.
+func (m *Map) IsEmpty() bool {
+	return len(m.keys) == 0
+}
+
+// Add adds peers to the ring, each replicated as m.replicas virtual nodes.
+func (m *Map) Add(peers ...string) {
+	for _, peer := range peers {
+		for i := 0; i < m.replicas; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + peer)))
+			m.keys = append(m.keys, hash)
+			m.hashMap[hash] = peer
+		}
+	}
+	sort.Ints(m.keys)
+}
+
+// Get returns the peer that owns key, chosen by walking clockwise from
+// key's hash to the nearest virtual node on the ring.
+func (m *Map) Get(key string) string {
+	if m.IsEmpty() {
+		return ""
+	}
+
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool { return m.keys[i] >= hash })
+
+	// Wrap around to the first node if we're past the end of the ring.
+	if idx == len(m.keys) {
+		idx = 0
+	}
+
+	return m.hashMap[m.keys[idx]]
+}
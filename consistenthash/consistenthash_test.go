@@ -0,0 +1,51 @@
+package consistenthash
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestGet checks that a key consistently maps to the same peer, and that
+// adding a new peer only reassigns the keys that now fall between it and
+// its ring neighbor.
+func TestGet(t *testing.T) {
+	// Use an identity-ish hash so the ring positions are predictable:
+	// the virtual node label itself, parsed as an integer.
+	hash := New(3, func(data []byte) uint32 {
+		n, _ := strconv.Atoi(string(data))
+		return uint32(n)
+	})
+
+	hash.Add("6", "4", "2")
+
+	testCases := map[string]string{
+		"2":  "2",
+		"11": "2",
+		"23": "4",
+		"27": "2",
+	}
+
+	for k, want := range testCases {
+		if got := hash.Get(k); got != want {
+			t.Errorf("Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+
+	// Adding "8" should only pull keys between "6" and "8" onto "8".
+	hash.Add("8")
+
+	testCases["27"] = "8"
+
+	for k, want := range testCases {
+		if got := hash.Get(k); got != want {
+			t.Errorf("after Add(8): Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestGetEmpty(t *testing.T) {
+	hash := New(3, nil)
+	if got := hash.Get("anything"); got != "" {
+		t.Errorf("Get on empty ring = %q, want \"\"", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTTL is how long a cached Accept-Ranges/Content-Length probe is
+// trusted before OriginRegistry.Probe re-issues the HEAD request.
+const probeTTL = 5 * time.Minute
+
+// defaultOriginTimeout is the HTTP client timeout used for an allowed
+// origin that didn't specify one via Allow.
+const defaultOriginTimeout = 10 * time.Second
+
+// originConfig holds the per-origin-prefix settings Allow registers.
+type originConfig struct {
+	timeout time.Duration
+}
+
+// probe is a cached result of HEAD-ing a source URL.
+type probe struct {
+	contentLength int64
+	rangesOK      bool
+	fetchedAt     time.Time
+}
+
+// OriginRegistry allow-lists which source URLs CacheServer will fetch
+// from - without it, a cache server that accepts an arbitrary "url"
+// query param is an open proxy - and caches each source URL's
+// Accept-Ranges/Content-Length probe for probeTTL so repeat requests
+// skip the HEAD round-trip. OriginRegistry is safe for concurrent use.
+type OriginRegistry struct {
+	mu      sync.Mutex
+	allowed []string // prefixes, in Allow call order
+	configs map[string]originConfig
+	probes  map[string]probe // keyed by exact source URL
+}
+
+// NewOriginRegistry creates an empty OriginRegistry. Call Allow to
+// permit origins before any request can be served.
+func NewOriginRegistry() *OriginRegistry {
+	return &OriginRegistry{
+		configs: make(map[string]originConfig),
+		probes:  make(map[string]probe),
+	}
+}
+
+// Allow adds prefix to the registry's allow-list: any source URL
+// starting with prefix may be fetched, using timeout for requests
+// against it. A zero timeout falls back to defaultOriginTimeout.
+func (r *OriginRegistry) Allow(prefix string, timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.allowed = append(r.allowed, prefix)
+	r.configs[prefix] = originConfig{timeout: timeout}
+}
+
+// Validate reports whether sourceURL is allowed, i.e. it starts with
+// one of the registry's allowed prefixes.
+func (r *OriginRegistry) Validate(sourceURL string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.match(sourceURL)
+	return ok
+}
+
+// match returns the allowed prefix sourceURL falls under, if any. Callers
+// must hold r.mu.
+func (r *OriginRegistry) match(sourceURL string) (string, bool) {
+	for _, prefix := range r.allowed {
+		if strings.HasPrefix(sourceURL, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// Timeout returns the HTTP client timeout configured for sourceURL's
+// matching allowed prefix, or defaultOriginTimeout if it matches none
+// (callers are expected to have already checked Validate).
+func (r *OriginRegistry) Timeout(sourceURL string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prefix, ok := r.match(sourceURL); ok {
+		if c := r.configs[prefix]; c.timeout > 0 {
+			return c.timeout
+		}
+	}
+	return defaultOriginTimeout
+}
+
+// Probe returns sourceURL's Accept-Ranges/Content-Length, from cache if
+// a probe less than probeTTL old exists, otherwise by issuing a fresh
+// HEAD request and caching the result.
+func (r *OriginRegistry) Probe(sourceURL string) (contentLength int64, rangesOK bool, err error) {
+	r.mu.Lock()
+	if p, ok := r.probes[sourceURL]; ok && time.Since(p.fetchedAt) < probeTTL {
+		r.mu.Unlock()
+		return p.contentLength, p.rangesOK, nil
+	}
+	r.mu.Unlock()
+
+	client := &http.Client{Timeout: r.Timeout(sourceURL)}
+	resp, err := client.Head(sourceURL)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	for _, v := range resp.Header["Accept-Ranges"] {
+		if v == "bytes" {
+			rangesOK = true
+		}
+	}
+	if rangesOK {
+		if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+
+	r.mu.Lock()
+	r.probes[sourceURL] = probe{contentLength: contentLength, rangesOK: rangesOK, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	return contentLength, rangesOK, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginRegistryValidate(t *testing.T) {
+	r := NewOriginRegistry()
+	r.Allow("https://example.com/videos/", 0)
+
+	if !r.Validate("https://example.com/videos/a.mp4") {
+		t.Fatalf("Validate(allowed URL) = false, want true")
+	}
+	if r.Validate("https://evil.example/a.mp4") {
+		t.Fatalf("Validate(disallowed URL) = true, want false")
+	}
+}
+
+func TestOriginRegistryTimeout(t *testing.T) {
+	r := NewOriginRegistry()
+	r.Allow("https://example.com/", 2*time.Second)
+	r.Allow("https://other.example/", 0)
+
+	if got := r.Timeout("https://example.com/a.mp4"); got != 2*time.Second {
+		t.Fatalf("Timeout(configured prefix) = %v, want 2s", got)
+	}
+	if got := r.Timeout("https://other.example/a.mp4"); got != defaultOriginTimeout {
+		t.Fatalf("Timeout(zero-configured prefix) = %v, want default %v", got, defaultOriginTimeout)
+	}
+	if got := r.Timeout("https://unregistered.example/a.mp4"); got != defaultOriginTimeout {
+		t.Fatalf("Timeout(unmatched URL) = %v, want default %v", got, defaultOriginTimeout)
+	}
+}
+
+func TestOriginRegistryProbeCaches(t *testing.T) {
+	var headCount int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headCount++
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "100")
+	}))
+	defer srv.Close()
+
+	r := NewOriginRegistry()
+	r.Allow(srv.URL, 0)
+
+	for i := 0; i < 3; i++ {
+		contentLength, rangesOK, err := r.Probe(srv.URL)
+		if err != nil {
+			t.Fatalf("Probe() error = %v", err)
+		}
+		if !rangesOK || contentLength != 100 {
+			t.Fatalf("Probe() = %d, %v, want 100, true", contentLength, rangesOK)
+		}
+	}
+	if headCount != 1 {
+		t.Fatalf("origin received %d HEAD requests, want 1 (later Probe calls should hit the cache)", headCount)
+	}
+}
+
+func TestOriginRegistryProbeNoRangeSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100") // no Accept-Ranges
+	}))
+	defer srv.Close()
+
+	r := NewOriginRegistry()
+	r.Allow(srv.URL, 0)
+
+	_, rangesOK, err := r.Probe(srv.URL)
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+	if rangesOK {
+		t.Fatalf("Probe() rangesOK = true, want false: origin didn't advertise Accept-Ranges: bytes")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zeneli/cacheserver/consistenthash"
+	"github.com/zeneli/cacheserver/rangecache"
+)
+
+const (
+	peerPath        = "/_cacheserver/"
+	defaultReplicas = 50
+)
+
+// PeerGetter fetches a keyrange from a single remote peer.
+type PeerGetter interface {
+	Get(sourceURL string, keyrange rangecache.Keyrange) ([]byte, error)
+}
+
+// PeerPicker locates the peer responsible for a cache key.
+type PeerPicker interface {
+	// PickPeer returns the peer owning key. ok is false if the key
+	// belongs to this instance, or no peers are registered.
+	PickPeer(key string) (peer PeerGetter, ok bool)
+}
+
+// RangeGetter satisfies a keyrange fetch through this instance's own
+// cache and duplicate suppression, the same path a local client's
+// request takes. *CacheServer implements this.
+type RangeGetter interface {
+	GetRangeDupSup(sourceURL string, keyrange rangecache.Keyrange, condHeaders http.Header) ([]byte, bool)
+}
+
+// HTTPPool implements PeerPicker over a set of peer base URLs arranged on
+// a consistent-hash ring, and serves peer-to-peer range fetches on
+// peerPath.
+type HTTPPool struct {
+	self string // this instance's base URL, e.g. "http://10.0.0.1:8080"
+
+	mu      sync.Mutex // guards peers, getters and local
+	peers   *consistenthash.Map
+	getters map[string]*httpGetter // peer base URL -> client
+	local   RangeGetter            // nil until SetLocal is called
+}
+
+// NewHTTPPool creates an HTTPPool that identifies itself as self, the
+// base URL other peers should use to reach this instance.
+func NewHTTPPool(self string) *HTTPPool {
+	return &HTTPPool{self: self}
+}
+
+// Set registers the pool of peers, replacing any previously registered
+// set. peers are base URLs, including self if this instance should also
+// serve keys.
+func (p *HTTPPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.peers = consistenthash.New(defaultReplicas, nil)
+	p.peers.Add(peers...)
+	p.getters = make(map[string]*httpGetter, len(peers))
+	for _, peer := range peers {
+		p.getters[peer] = &httpGetter{baseURL: peer + peerPath}
+	}
+}
+
+// SetLocal registers the RangeGetter HTTPPool forwards peer-to-peer
+// fetches to, so that a stampede of peers requesting the same
+// (url, keyrange) from the owning node collapses to one origin fetch
+// and is cached for the next peer, exactly as it would for a local
+// client. Until SetLocal is called, ServeHTTP refuses every request.
+func (p *HTTPPool) SetLocal(rg RangeGetter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.local = rg
+}
+
+// PickPeer implements PeerPicker.
+func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil || p.peers.IsEmpty() {
+		return nil, false
+	}
+	if peer := p.peers.Get(key); peer != p.self {
+		return p.getters[peer], true
+	}
+	return nil, false
+}
+
+// ServeHTTP answers peer-to-peer range fetches of the form
+// "/_cacheserver/<url>|<start>-<end>".
+func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, peerPath) {
+		http.Error(w, "HTTPPool serving unexpected path: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+
+	sourceURL, keyrange, err := decodeKey(strings.TrimPrefix(r.URL.Path, peerPath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	local := p.local
+	p.mu.Unlock()
+	if local == nil {
+		http.Error(w, "HTTPPool: no local cache registered", http.StatusInternalServerError)
+		return
+	}
+
+	// Go through the owning node's own cache and duplicate suppression,
+	// the same as a local client would, so concurrent peers asking for
+	// the same (url, keyrange) collapse to one origin fetch.
+	body, ok := local.GetRangeDupSup(sourceURL, keyrange, nil)
+	if !ok {
+		http.Error(w, fmt.Sprintf("fetching %s: upstream error", sourceURL), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+// httpGetter is a PeerGetter backed by an HTTPPool peer.
+type httpGetter struct {
+	baseURL string
+}
+
+// Get fetches keyrange from the peer over HTTP.
+func (h *httpGetter) Get(sourceURL string, keyrange rangecache.Keyrange) ([]byte, error) {
+	resp, err := http.Get(h.baseURL + encodeKey(sourceURL, keyrange))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// encodeKey formats a cache key as "url|start-end", the format the peer
+// ring is keyed on and peer-to-peer request paths carry.
+func encodeKey(sourceURL string, keyrange rangecache.Keyrange) string {
+	return fmt.Sprintf("%s|%d-%d", sourceURL, keyrange.Start, keyrange.End)
+}
+
+// decodeKey parses a key produced by encodeKey.
+func decodeKey(key string) (sourceURL string, keyrange rangecache.Keyrange, err error) {
+	parts := strings.SplitN(key, "|", 2)
+	if len(parts) != 2 {
+		return "", rangecache.Keyrange{}, errors.New("malformed peer key: missing '|'")
+	}
+	sourceURL = parts[0]
+
+	bounds := strings.SplitN(parts[1], "-", 2)
+	if len(bounds) != 2 {
+		return "", rangecache.Keyrange{}, errors.New("malformed peer key: missing '-'")
+	}
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return "", rangecache.Keyrange{}, err
+	}
+	end, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return "", rangecache.Keyrange{}, err
+	}
+	return sourceURL, rangecache.Keyrange{Start: start, End: end}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeneli/cacheserver/rangecache"
+)
+
+func TestEncodeDecodeKey(t *testing.T) {
+	sourceURL := "http://example.com/video.mp4"
+	kr := rangecache.Keyrange{Start: 100, End: 200}
+
+	gotURL, gotKr, err := decodeKey(encodeKey(sourceURL, kr))
+	if err != nil {
+		t.Fatalf("decodeKey: unexpected error: %v", err)
+	}
+	if gotURL != sourceURL || gotKr != kr {
+		t.Fatalf("decodeKey(encodeKey(%q, %v)) = %q, %v, want %q, %v", sourceURL, kr, gotURL, gotKr, sourceURL, kr)
+	}
+}
+
+func TestHTTPPoolPickPeerExcludesSelf(t *testing.T) {
+	pool := NewHTTPPool("http://peer-a:8080")
+	pool.Set("http://peer-a:8080", "http://peer-b:8080", "http://peer-c:8080")
+
+	// Hammer a spread of keys; every pick must resolve to a peer other
+	// than self, never to self.
+	for i := 0; i < 100; i++ {
+		key := encodeKey("http://example.com/video.mp4", rangecache.Keyrange{Start: i * 1000, End: i*1000 + 999})
+		peer, ok := pool.PickPeer(key)
+		if ok && peer == nil {
+			t.Fatalf("PickPeer(%q) returned ok=true with a nil peer", key)
+		}
+		if ok && peer == pool.getters["http://peer-a:8080"] {
+			t.Fatalf("PickPeer(%q) returned self, want a peer other than self or ok=false", key)
+		}
+	}
+}
+
+func TestHTTPPoolPickPeerNoPeers(t *testing.T) {
+	pool := NewHTTPPool("http://peer-a:8080")
+	if _, ok := pool.PickPeer("anything"); ok {
+		t.Fatalf("PickPeer on an empty pool returned ok=true, want false")
+	}
+}
+
+// TestHTTPPoolServeHTTPForwardsToLocalCache verifies that ServeHTTP
+// answers a peer's request through this instance's own cache and
+// duplicate suppression (via SetLocal) rather than fetching the origin
+// directly: concurrent peer requests for the same (url, keyrange) must
+// collapse to a single origin hit, and the result must be served from
+// cache thereafter.
+func TestHTTPPoolServeHTTPForwardsToLocalCache(t *testing.T) {
+	body := []byte("hello world")
+	var hits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	cs := NewCacheServer(nbytesMax)
+	pool := NewHTTPPool("http://self:8080")
+	pool.SetLocal(cs)
+
+	kr := rangecache.Keyrange{Start: 0, End: 10}
+	path := peerPath + encodeKey(origin.URL, kr)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", path, nil)
+			pool.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("ServeHTTP status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Body.String(); got != string(body) {
+				t.Errorf("ServeHTTP body = %q, want %q", got, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("origin hits = %d, want 1 (duplicate suppression should collapse concurrent peer requests)", got)
+	}
+}
+
+// fakePeerPicker routes exactly one keyrange to peer; everything else
+// reports ok=false, so GetRangeDupSup falls through to the origin.
+type fakePeerPicker struct {
+	route rangecache.Keyrange
+	peer  PeerGetter
+}
+
+func (f fakePeerPicker) PickPeer(key string) (PeerGetter, bool) {
+	_, kr, err := decodeKey(key)
+	if err != nil || kr != f.route {
+		return nil, false
+	}
+	return f.peer, true
+}
+
+// fakePeerGetter always returns body, regardless of what's requested.
+type fakePeerGetter struct{ body []byte }
+
+func (f fakePeerGetter) Get(sourceURL string, keyrange rangecache.Keyrange) ([]byte, error) {
+	return f.body, nil
+}
+
+// TestGetRangeDupSupCachesPeerFetchAsSecondary checks that a
+// peer-forwarded range is cached at a lower eviction priority than one
+// fetched directly from the origin: once the cache is full, the
+// peer-forwarded range should be the one evicted to make room.
+func TestGetRangeDupSupCachesPeerFetchAsSecondary(t *testing.T) {
+	primaryBody := []byte("primary-a") // 9 bytes
+	origin := rangeOrigin(t, primaryBody)
+	defer origin.Close()
+
+	secondaryBody := []byte("secondary") // 9 bytes
+	peerRoute := rangecache.Keyrange{Start: 100, End: 108}
+
+	cs := NewCacheServer(int64(len(primaryBody) + len(secondaryBody))) // room for exactly both
+	cs.SetPeers(fakePeerPicker{route: peerRoute, peer: fakePeerGetter{body: secondaryBody}})
+
+	primaryRange := rangecache.Keyrange{Start: 0, End: 8}
+	if _, ok := cs.GetRangeDupSup(origin.URL, primaryRange, nil); !ok {
+		t.Fatalf("GetRangeDupSup(primary) = _, false, want true")
+	}
+	if _, ok := cs.GetRangeDupSup(origin.URL, peerRoute, nil); !ok {
+		t.Fatalf("GetRangeDupSup(peerRoute) = _, false, want true")
+	}
+
+	// The cache is now exactly full; caching one more distinct range
+	// forces an eviction. The peer-forwarded range should go first.
+	cs.add(origin.URL, rangecache.Keyrange{Start: 200, End: 200}, []byte("x"))
+
+	if _, ok := cs.get(origin.URL, peerRoute); ok {
+		t.Fatalf("peer-forwarded range survived eviction, want it evicted before the primary one")
+	}
+	if _, ok := cs.get(origin.URL, primaryRange); !ok {
+		t.Fatalf("primary range was evicted, want the peer-forwarded one evicted first")
+	}
+}
+
+func TestHTTPPoolServeHTTPNoLocal(t *testing.T) {
+	pool := NewHTTPPool("http://self:8080")
+	kr := rangecache.Keyrange{Start: 0, End: 10}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", peerPath+encodeKey("http://example.com/video.mp4", kr), nil)
+	pool.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
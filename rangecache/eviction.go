@@ -0,0 +1,96 @@
+package rangecache
+
+import "container/list"
+
+// EvictionPolicy decides which cached range to discard when RangeCache
+// needs room, and optionally rejects a new range outright before it's
+// ever stored. Implementations are not safe for concurrent use; callers
+// synchronize through RangeCache the same way they do for the cache
+// itself.
+type EvictionPolicy interface {
+	// Admit is called the first time key is added, with its byte cost.
+	// A false return means key should not be cached at all (used by
+	// admission filters like the sampled-LFU policy's TinyLFU-style
+	// filter); most policies always return true.
+	Admit(key Keyrange, cost int64) bool
+
+	// Touch records an access to an already-admitted key, e.g. a cache
+	// hit or a Stitch that used it.
+	Touch(key Keyrange)
+
+	// Victim returns the key the policy would like evicted next. ok is
+	// false if the policy has nothing left to evict.
+	Victim() (key Keyrange, ok bool)
+
+	// Remove tells the policy that key is no longer resident in
+	// RangeCache, e.g. after Victim's choice was actually evicted, or a
+	// Stitch merged it into a larger entry.
+	Remove(key Keyrange)
+}
+
+// SecondaryAdmitter is an optional extension to EvictionPolicy. A
+// policy that implements it distinguishes a "hot" secondary entry -
+// e.g. a range relayed from a peer's cache rather than fetched by this
+// instance directly - from an ordinary primary one, typically by
+// admitting it at a lower eviction priority. Policies that don't
+// implement SecondaryAdmitter are used via their ordinary Admit for
+// both cases (see RangeCache.AddSecondary).
+type SecondaryAdmitter interface {
+	AdmitSecondary(key Keyrange, cost int64) bool
+}
+
+// Option configures a RangeCache constructed via NewRangeCache.
+type Option func(*RangeCache)
+
+// WithEvictionPolicy overrides the default LRU eviction policy.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(rc *RangeCache) { rc.policy = policy }
+}
+
+// lruPolicy is the default EvictionPolicy: evict whatever was accessed
+// longest ago.
+type lruPolicy struct {
+	list  *list.List // front = most recently used; Value is a Keyrange
+	elems map[Keyrange]*list.Element
+}
+
+// NewLRUPolicy creates an EvictionPolicy that evicts the
+// least-recently-used range.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{list: list.New(), elems: make(map[Keyrange]*list.Element)}
+}
+
+func (p *lruPolicy) Admit(key Keyrange, cost int64) bool {
+	p.elems[key] = p.list.PushFront(key)
+	return true
+}
+
+// AdmitSecondary implements SecondaryAdmitter: a secondary entry is
+// pushed to the back of the recency list instead of the front, so it's
+// the next thing evicted rather than competing on equal footing with
+// ranges this instance fetched itself.
+func (p *lruPolicy) AdmitSecondary(key Keyrange, cost int64) bool {
+	p.elems[key] = p.list.PushBack(key)
+	return true
+}
+
+func (p *lruPolicy) Touch(key Keyrange) {
+	if e, ok := p.elems[key]; ok {
+		p.list.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Victim() (Keyrange, bool) {
+	e := p.list.Back()
+	if e == nil {
+		return Keyrange{}, false
+	}
+	return e.Value.(Keyrange), true
+}
+
+func (p *lruPolicy) Remove(key Keyrange) {
+	if e, ok := p.elems[key]; ok {
+		p.list.Remove(e)
+		delete(p.elems, key)
+	}
+}
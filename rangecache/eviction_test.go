@@ -0,0 +1,99 @@
+package rangecache
+
+import "testing"
+
+func TestLRUPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	p := NewLRUPolicy()
+	a, b, c := Keyrange{0, 10}, Keyrange{20, 30}, Keyrange{40, 50}
+	p.Admit(a, 1)
+	p.Admit(b, 1)
+	p.Admit(c, 1)
+
+	p.Touch(a) // a is now most recently used; b is least.
+
+	victim, ok := p.Victim()
+	if !ok || victim != b {
+		t.Fatalf("Victim() = %v, %v, want %v, true", victim, ok, b)
+	}
+
+	p.Remove(b)
+	victim, ok = p.Victim()
+	if !ok || victim != c {
+		t.Fatalf("after removing %v, Victim() = %v, %v, want %v, true", b, victim, ok, c)
+	}
+}
+
+func TestLRUPolicyVictimEmpty(t *testing.T) {
+	p := NewLRUPolicy()
+	if _, ok := p.Victim(); ok {
+		t.Fatalf("Victim() on an empty policy returned ok=true")
+	}
+}
+
+// TestLRUPolicyAdmitSecondaryEvictsFirst checks that a secondary entry
+// is placed at the back of the recency list, so it's the next thing
+// evicted even though it was admitted after an ordinary (primary)
+// entry.
+func TestLRUPolicyAdmitSecondaryEvictsFirst(t *testing.T) {
+	p := NewLRUPolicy().(*lruPolicy)
+	primary, secondary := Keyrange{0, 10}, Keyrange{20, 30}
+
+	p.Admit(primary, 1)
+	p.AdmitSecondary(secondary, 1)
+
+	victim, ok := p.Victim()
+	if !ok || victim != secondary {
+		t.Fatalf("Victim() = %v, %v, want %v, true: a secondary entry should evict before an untouched primary one", victim, ok, secondary)
+	}
+}
+
+// TestRangeCacheAddSecondaryEvictsFirst checks that RangeCache.AddSecondary
+// is wired through to the eviction policy's SecondaryAdmitter, end to
+// end: once the cache is full, adding a third range should evict the
+// secondary one rather than either primary range.
+func TestRangeCacheAddSecondaryEvictsFirst(t *testing.T) {
+	rc := NewRangeCache(3) // room for exactly 3 one-byte entries
+
+	primaryA := Keyrange{0, 0}
+	secondary := Keyrange{10, 10}
+	primaryB := Keyrange{20, 20}
+	rc.Add(primaryA, []byte("a"))
+	rc.AddSecondary(secondary, []byte("s"))
+	rc.Add(primaryB, []byte("b"))
+
+	evicted := Keyrange{30, 30}
+	rc.Add(evicted, []byte("e"))
+
+	if _, ok := rc.Get(secondary); ok {
+		t.Fatalf("Get(%v) = _, true, want false: the secondary entry should have been evicted first", secondary)
+	}
+	if _, ok := rc.Get(primaryA); !ok {
+		t.Fatalf("Get(%v) = _, false, want true: a primary entry shouldn't be evicted before the secondary one", primaryA)
+	}
+	if _, ok := rc.Get(primaryB); !ok {
+		t.Fatalf("Get(%v) = _, false, want true: a primary entry shouldn't be evicted before the secondary one", primaryB)
+	}
+}
+
+// TestRangeCacheWithEvictionPolicy checks that WithEvictionPolicy is
+// actually wired up: a policy that refuses every Admit should leave the
+// cache permanently empty.
+func TestRangeCacheWithEvictionPolicy(t *testing.T) {
+	rc := NewRangeCache(64000000, WithEvictionPolicy(&refuseAllPolicy{}))
+
+	kr := Keyrange{0, 10}
+	rc.Add(kr, []byte("hello"))
+
+	if _, ok := rc.Get(kr); ok {
+		t.Fatalf("Get(%v) = _, true, want false: refuseAllPolicy should have rejected the Add", kr)
+	}
+}
+
+// refuseAllPolicy is a minimal EvictionPolicy used only to prove
+// WithEvictionPolicy's Admit return value is honored.
+type refuseAllPolicy struct{}
+
+func (refuseAllPolicy) Admit(Keyrange, int64) bool { return false }
+func (refuseAllPolicy) Touch(Keyrange)             {}
+func (refuseAllPolicy) Victim() (Keyrange, bool)   { return Keyrange{}, false }
+func (refuseAllPolicy) Remove(Keyrange)            {}
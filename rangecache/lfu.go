@@ -0,0 +1,190 @@
+package rangecache
+
+import "container/list"
+
+// sampledLFUPolicy is an approximate-LFU EvictionPolicy: a count-min
+// sketch estimates each range's access frequency in constant space, and
+// a TinyLFU-style admission filter rejects a brand-new candidate
+// outright once resident entries reach capacity and the candidate looks less popular
+// than the entry it would have to evict. That keeps a one-off scan
+// (e.g. a single full-file re-encode) from flushing out ranges that get
+// replayed often.
+type sampledLFUPolicy struct {
+	sketch *countMinSketch
+
+	capacity int        // admission filter only kicks in once resident reaches this many entries
+	resident *list.List // recency order; sampled (not scanned) to find a victim
+	elems    map[Keyrange]*list.Element
+}
+
+// sampleSize bounds how many of the least-recently-touched resident
+// entries Victim inspects before picking whichever has the lowest
+// estimated frequency. This is what makes the policy "sampled" rather
+// than an exact (and much more expensive) global-minimum LFU.
+const sampleSize = 5
+
+// NewSampledLFUPolicy creates an approximate-LFU EvictionPolicy sized
+// for roughly capacity distinct resident ranges. capacity sizes the
+// frequency sketch and is also the resident-entry count at which the
+// admission filter starts rejecting candidates; it is independent of
+// the RangeCache's byte limit.
+func NewSampledLFUPolicy(capacity int) EvictionPolicy {
+	return &sampledLFUPolicy{
+		sketch:   newCountMinSketch(capacity),
+		capacity: capacity,
+		resident: list.New(),
+		elems:    make(map[Keyrange]*list.Element),
+	}
+}
+
+// Admit only runs the TinyLFU-style rejection once the policy is
+// actually carrying capacity resident entries; below that there's no
+// pressure to weigh the candidate against anything, so it's always
+// admitted (RangeCache.Add's own byte-limit eviction loop is what
+// handles genuine capacity pressure).
+func (p *sampledLFUPolicy) Admit(key Keyrange, cost int64) bool {
+	p.sketch.Add(key)
+
+	if p.resident.Len() >= p.capacity {
+		if victim, ok := p.Victim(); ok && victim != key {
+			if p.sketch.Estimate(key) < p.sketch.Estimate(victim) {
+				return false // candidate is less popular than what we'd evict for it
+			}
+		}
+	}
+
+	p.elems[key] = p.resident.PushFront(key)
+	return true
+}
+
+func (p *sampledLFUPolicy) Touch(key Keyrange) {
+	p.sketch.Add(key)
+	if e, ok := p.elems[key]; ok {
+		p.resident.MoveToFront(e)
+	}
+}
+
+// Victim samples up to sampleSize of the least-recently-touched
+// resident keys and returns whichever has the lowest estimated
+// frequency - a bounded approximation of "evict the globally
+// least-frequently-used key" that avoids an O(n) scan over everything
+// resident.
+func (p *sampledLFUPolicy) Victim() (Keyrange, bool) {
+	e := p.resident.Back()
+	if e == nil {
+		return Keyrange{}, false
+	}
+	victim := e.Value.(Keyrange)
+	victimFreq := p.sketch.Estimate(victim)
+	for i, cur := 0, e.Prev(); i < sampleSize-1 && cur != nil; i, cur = i+1, cur.Prev() {
+		key := cur.Value.(Keyrange)
+		if f := p.sketch.Estimate(key); f < victimFreq {
+			victim, victimFreq = key, f
+		}
+	}
+	return victim, true
+}
+
+func (p *sampledLFUPolicy) Remove(key Keyrange) {
+	if e, ok := p.elems[key]; ok {
+		p.resident.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+// countMinSketch is a fixed-size approximate frequency counter: each of
+// depth independent hash functions maps a key to one of width 4-bit
+// counters, and Estimate takes the minimum across rows to cancel out
+// (without ever undercounting) the collisions any single row suffers.
+// Counters are halved periodically so the sketch tracks recent access
+// patterns instead of accumulating forever.
+type countMinSketch struct {
+	width           int
+	counters        [4][]uint8 // 4-bit counters, stored one per byte for simplicity
+	totalIncrements int64
+	halvingPeriod   int64
+}
+
+// cmsRowSeeds are arbitrary odd constants mixed into each row's hash so
+// the 4 rows index independently; they have no significance beyond
+// being distinct and nonzero.
+var cmsRowSeeds = [4]uint32{0x9e3779b1, 0x85ebca6b, 0xc2b2ae35, 0x27d4eb2f}
+
+// newCountMinSketch sizes the sketch for roughly capacity distinct
+// keys: width is 8x capacity (per the usual count-min sketch rule of
+// thumb for a low collision rate at 4 rows), and halvingPeriod is 10x
+// capacity total increments, after which all counters are halved to
+// decay stale frequency history.
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := capacity * 8
+	if width < 64 {
+		width = 64
+	}
+	cms := &countMinSketch{width: width, halvingPeriod: int64(capacity) * 10}
+	if cms.halvingPeriod <= 0 {
+		cms.halvingPeriod = 640
+	}
+	for row := range cms.counters {
+		cms.counters[row] = make([]uint8, width)
+	}
+	return cms
+}
+
+func (cms *countMinSketch) indices(key Keyrange) [4]int {
+	var idx [4]int
+	for row, seed := range cmsRowSeeds {
+		idx[row] = int(hashKeyrange(key, seed) % uint32(cms.width))
+	}
+	return idx
+}
+
+// Add records one access to key, saturating each counter at 15 (the
+// max a 4-bit counter can hold).
+func (cms *countMinSketch) Add(key Keyrange) {
+	for row, i := range cms.indices(key) {
+		if cms.counters[row][i] < 15 {
+			cms.counters[row][i]++
+		}
+	}
+	cms.totalIncrements++
+	if cms.totalIncrements >= cms.halvingPeriod {
+		cms.halve()
+	}
+}
+
+// Estimate returns key's estimated access frequency (0-15).
+func (cms *countMinSketch) Estimate(key Keyrange) uint8 {
+	min := uint8(15)
+	for row, i := range cms.indices(key) {
+		if c := cms.counters[row][i]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (cms *countMinSketch) halve() {
+	for row := range cms.counters {
+		for i, c := range cms.counters[row] {
+			cms.counters[row][i] = c / 2
+		}
+	}
+	cms.totalIncrements /= 2
+}
+
+// hashKeyrange is a small FNV-1a-style hash over key's two bounds and a
+// row seed, good enough to decorrelate the count-min sketch's rows.
+func hashKeyrange(key Keyrange, seed uint32) uint32 {
+	h := uint32(2166136261) ^ seed
+	h = fnv1aMix(h, uint32(key.Start))
+	h = fnv1aMix(h, uint32(key.End))
+	return h
+}
+
+func fnv1aMix(h, v uint32) uint32 {
+	for i := 0; i < 4; i++ {
+		h ^= (v >> uint(8*i)) & 0xff
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package rangecache
+
+import "testing"
+
+func TestCountMinSketchEstimateGrowsWithAdds(t *testing.T) {
+	cms := newCountMinSketch(100)
+	hot, cold := Keyrange{0, 10}, Keyrange{20, 30}
+
+	for i := 0; i < 5; i++ {
+		cms.Add(hot)
+	}
+	cms.Add(cold)
+
+	if got := cms.Estimate(hot); got < 5 {
+		t.Fatalf("Estimate(hot) = %d, want >= 5", got)
+	}
+	if got := cms.Estimate(cold); got < 1 {
+		t.Fatalf("Estimate(cold) = %d, want >= 1", got)
+	}
+}
+
+func TestCountMinSketchHalves(t *testing.T) {
+	cms := newCountMinSketch(1) // halvingPeriod = 10
+	key := Keyrange{0, 10}
+	for i := 0; i < 20; i++ {
+		cms.Add(key)
+	}
+	if got := cms.Estimate(key); got >= 15 {
+		t.Fatalf("Estimate(key) = %d after halving, want < 15 (periodic halving should have kicked in)", got)
+	}
+}
+
+// TestSampledLFUPolicyAdmissionFilter checks the TinyLFU-style
+// admission filter: once the policy is full (resident count at
+// capacity) and its coldest resident entry is much hotter than a
+// brand-new candidate, that candidate should be rejected rather than
+// evicting the hotter entry for it.
+func TestSampledLFUPolicyAdmissionFilter(t *testing.T) {
+	p := NewSampledLFUPolicy(1)
+	hot, coldCandidate := Keyrange{0, 10}, Keyrange{100, 200}
+
+	p.Admit(hot, 1) // resident now at capacity (1): the filter has pressure to apply
+	for i := 0; i < 5; i++ {
+		p.Touch(hot)
+	}
+
+	if ok := p.Admit(coldCandidate, 1); ok {
+		t.Fatalf("Admit(%v) = true, want false: a cold one-off candidate shouldn't bump a much hotter resident once the policy is full", coldCandidate)
+	}
+}
+
+// TestSampledLFUPolicyAdmitsBelowCapacity checks that the admission
+// filter stays out of the way when the policy has room to spare: a
+// brand-new candidate should never be rejected just because some other
+// range is hot, as long as resident count hasn't reached capacity.
+func TestSampledLFUPolicyAdmitsBelowCapacity(t *testing.T) {
+	p := NewSampledLFUPolicy(10)
+	hot, coldCandidate := Keyrange{0, 10}, Keyrange{20, 30}
+
+	p.Admit(hot, 1)
+	for i := 0; i < 10; i++ {
+		p.Touch(hot)
+	}
+
+	if ok := p.Admit(coldCandidate, 1); !ok {
+		t.Fatalf("Admit(%v) = false, want true: resident count (1) is far below capacity (10), so there's no pressure to reject anything", coldCandidate)
+	}
+}
+
+func TestSampledLFUPolicyVictimPrefersColder(t *testing.T) {
+	p := NewSampledLFUPolicy(10)
+	hot, cold := Keyrange{0, 10}, Keyrange{20, 30}
+
+	p.Admit(cold, 1)
+	p.Admit(hot, 1)
+	for i := 0; i < 10; i++ {
+		p.Touch(hot)
+	}
+
+	victim, ok := p.Victim()
+	if !ok || victim != cold {
+		t.Fatalf("Victim() = %v, %v, want %v, true", victim, ok, cold)
+	}
+}
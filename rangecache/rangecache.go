@@ -1,154 +1,290 @@
-// Package rangecache implements a range cache based on LRU policy.
+// Package rangecache implements a range cache with a pluggable eviction
+// policy, backed by an augmented interval tree so overlapping and
+// adjacent ranges can be looked up and stitched together in O(log n +
+// k) instead of scanned.
 package rangecache
 
 import (
-	"container/list"
+	"sort"
 )
 
-// Keyrange is comparable key.
+// Keyrange is a comparable key.
 // Keyrange describes an inclusive range, viz. [Start, End]
 type Keyrange struct{ Start, End int }
 
-// RangeCache is a LRU range-based cache.
-// RangeCache is not safe for concurrent accesses.
+// Sizer is implemented by cached values that know their own real byte
+// cost. Values that don't implement it fall back to sizeOf's built-in
+// handling of []byte and []int.
+type Sizer interface {
+	Size() int64
+}
+
+// sizeOf reports value's real byte cost, used for both capacity
+// accounting and eviction. Assumes a 64-bit platform: an int is 8
+// bytes.
+func sizeOf(value interface{}) int64 {
+	if s, ok := value.(Sizer); ok {
+		return s.Size()
+	}
+	switch v := value.(type) {
+	case []byte:
+		return int64(len(v))
+	case []int:
+		return int64(len(v)) * 8
+	default:
+		return 0
+	}
+}
+
+// RangeCache is a range-based cache backed by an interval tree, with
+// eviction ordering delegated to a pluggable EvictionPolicy (LRU by
+// default; see WithEvictionPolicy). RangeCache is not safe for
+// concurrent accesses.
 type RangeCache struct {
-	lrulist    *list.List
-	rangecache map[Keyrange]*list.Element
+	tree       *tree
+	policy     EvictionPolicy
 	nbytesUsed int64
 	nbyteLimit int64
 }
 
-type item struct {
-	keyrange Keyrange
-	value    interface{}
-}
-
-// NewRangeCache creates a new RangeCache.
-func NewRangeCache(byteLimit int64) *RangeCache {
-	return &RangeCache{
-		lrulist:    list.New(),
-		rangecache: make(map[Keyrange]*list.Element),
+// NewRangeCache creates a new RangeCache with the given byte limit. By
+// default it evicts least-recently-used entries; pass
+// WithEvictionPolicy to use a different EvictionPolicy.
+func NewRangeCache(byteLimit int64, opts ...Option) *RangeCache {
+	rc := &RangeCache{
+		tree:       newTree(),
+		policy:     NewLRUPolicy(),
 		nbytesUsed: 0,
 		nbyteLimit: byteLimit,
 	}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	return rc
+}
+
+// lazyInit brings up a zero-value RangeCache{} to a usable state with a
+// default 64 MB limit and the default LRU eviction policy.
+func (rc *RangeCache) lazyInit() {
+	if rc.tree == nil {
+		rc.tree = newTree()
+		rc.policy = NewLRUPolicy()
+		rc.nbyteLimit = 64000000 // 64MB default.
+	}
 }
 
-// Add associates a keyrange with a value and addes it to the range cache.
-// If the range cache is nil, then create one with a default size of 64 MB.
+// Add associates a keyrange with a value and adds it to the range
+// cache, evicting entries as needed, per the configured EvictionPolicy,
+// to make room under the byte limit. If the policy has nothing left to
+// evict, the value is stored anyway and the limit is exceeded.
 func (rc *RangeCache) Add(keyrange Keyrange, value interface{}) {
-	if rc.rangecache == nil { // Guard against empty range cache.
-		rc = NewRangeCache(64000000) // 64MB default.
+	rc.lazyInit()
+	rc.add(keyrange, value, rc.policy.Admit)
+}
+
+// AddSecondary is like Add, but for a value this instance didn't fetch
+// itself - e.g. a range relayed from a peer's own cache rather than
+// pulled from the origin. It's cached the same way, except eviction
+// policies that implement SecondaryAdmitter get a chance to treat it as
+// a lower-priority "hot" entry (see SecondaryAdmitter); policies that
+// don't implement it fall back to Add's ordinary admission check.
+func (rc *RangeCache) AddSecondary(keyrange Keyrange, value interface{}) {
+	rc.lazyInit()
+	admit := rc.policy.Admit
+	if p, ok := rc.policy.(SecondaryAdmitter); ok {
+		admit = p.AdmitSecondary
 	}
-	// Cache hit.
-	if e, ok := rc.rangecache[keyrange]; ok {
-		rc.lrulist.MoveToFront(e)
-		e.Value.(*item).value = value
+	rc.add(keyrange, value, admit)
+}
+
+func (rc *RangeCache) add(keyrange Keyrange, value interface{}, admit func(Keyrange, int64) bool) {
+	rc.lazyInit()
+
+	if n := rc.tree.search(keyrange); n != nil { // Cache hit: replace value in place.
+		n.value = value
+		rc.policy.Touch(keyrange)
 		return
 	}
 
-	// Before Add, check storage constraints. Evict if not met.
-	var nbytesReq int64
-	switch value.(type) {
-	case []int:
-		nbytesReq = int64(len(value.([]int)) * 64)
-	case []byte:
-		nbytesReq = int64(len(value.([]byte)))
+	nbytesReq := sizeOf(value)
+	if !admit(keyrange, nbytesReq) {
+		return // policy rejected this candidate outright
 	}
-	nbytesAvailable := rc.nbyteLimit - rc.nbytesUsed
 
-	// log.Printf("nbytesAvailable(%v) < nbytesReq(%v)\n", nbytesAvailable, nbytesReq)
-	for nbytesAvailable < nbytesReq {
-		rc.evict()
-		nbytesAvailable = rc.nbyteLimit - rc.nbytesUsed
+	for rc.nbyteLimit-rc.nbytesUsed < nbytesReq {
+		if !rc.evict() {
+			break // nothing left to evict; store anyway rather than refuse
+		}
 	}
-	e := rc.lrulist.PushFront(&item{keyrange, value})
-	rc.rangecache[keyrange] = e
 
-	// Assume 64-bit architecture. int is 64 bits wide on 64-bit systems.
-	switch value.(type) {
-	case []int:
-		rc.nbytesUsed += int64(len(e.Value.(*item).value.([]int)) * 64)
-	case []byte:
-		rc.nbytesUsed += int64(len(e.Value.(*item).value.([]byte)))
-	}
-	// log.Printf("nbytesUsed: %d\n", rc.nbytesUsed)
+	rc.tree.insert(keyrange, value)
+	rc.nbytesUsed += nbytesReq
 }
 
-// Get looks up a keyrange's value from the range cache.
+// Get looks up a keyrange's value from the range cache. An exact
+// (Start, End) match is returned directly. Failing that, Get looks for
+// a set of cached ranges whose union covers keyrange and, if found,
+// returns the correctly-offset concatenation of their overlapping
+// portions (see Stitch).
 func (rc *RangeCache) Get(keyrange Keyrange) (value interface{}, ok bool) {
-	if rc.rangecache == nil {
+	if rc.tree == nil {
 		return nil, false
 	}
-	if e, ok := rc.rangecache[keyrange]; ok { // Fast hit.
-		rc.lrulist.MoveToFront(e)
-		return e.Value.(*item).value, true
-	} else if e, v, ok := rc.liesInRange(keyrange); ok { // Slow hit.
-		rc.lrulist.MoveToFront(e)
-		return v, ok
+	if n := rc.tree.search(keyrange); n != nil { // Fast hit.
+		rc.policy.Touch(keyrange)
+		return n.value, true
 	}
-	return nil, false
+	return rc.Stitch(keyrange)
 }
 
-// evict evicts the least recently used keyrange and value item from the range cache.
-func (rc *RangeCache) evict() {
-	if rc.rangecache == nil {
-		return
+// Stitch looks for cached ranges whose union covers keyrange and, if
+// their union does, returns the concatenation of the relevant slice of
+// each: segment n contributes value[keyrange.Start-n.Start :
+// keyrange.End-n.Start+1], clamped to the part not already supplied by
+// an earlier, lower segment. Overlapping or touching segments used to
+// satisfy the request are merged into a single larger cache entry
+// afterward, to reduce fragmentation.
+func (rc *RangeCache) Stitch(keyrange Keyrange) (interface{}, bool) {
+	overlaps := rc.tree.overlapping(keyrange)
+	if len(overlaps) == 0 {
+		return nil, false
+	}
+	sort.Slice(overlaps, func(i, j int) bool { return overlaps[i].keyrange.Start < overlaps[j].keyrange.Start })
+
+	var used []*node
+	next := keyrange.Start
+	for _, n := range overlaps {
+		if n.keyrange.End < next {
+			continue // fully covered by a segment already selected
+		}
+		if n.keyrange.Start > next {
+			return nil, false // gap: union does not cover keyrange
+		}
+		used = append(used, n)
+		next = n.keyrange.End + 1
+		if next > keyrange.End {
+			break
+		}
+	}
+	if next <= keyrange.End {
+		return nil, false // ran out of overlaps before covering keyrange.End
 	}
-	e := rc.lrulist.Back()
-	if e != nil {
-		rc.lrulist.Remove(e)
-		item := e.Value.(*item)
-		delete(rc.rangecache, item.keyrange)
-		var bFreed int64
-		switch item.value.(type) {
-		case []int:
-			bFreed = int64(len(item.value.([]int)) * 64)
-		case []byte:
-			bFreed = int64(len(item.value.([]byte)) * 64)
+
+	value, ok := stitchSegments(used, keyrange)
+	if !ok {
+		return nil, false
+	}
+	for _, n := range used {
+		rc.policy.Touch(n.keyrange)
+	}
+	rc.mergeSegments(used)
+	return value, true
+}
+
+// stitchSegments concatenates the part of each node in segments that
+// falls within keyrange. segments must be sorted by Start and, taken
+// together, must cover keyrange with no gaps (Stitch guarantees this
+// before calling).
+func stitchSegments(segments []*node, keyrange Keyrange) (interface{}, bool) {
+	switch segments[0].value.(type) {
+	case []byte:
+		out := make([]byte, 0, keyrange.End-keyrange.Start+1)
+		next := keyrange.Start
+		for _, n := range segments {
+			v, ok := n.value.([]byte)
+			if !ok {
+				return nil, false
+			}
+			lo, hi, ok := sliceBounds(n.keyrange, next, keyrange.End, len(v))
+			if !ok {
+				return nil, false
+			}
+			out = append(out, v[lo:hi]...)
+			next = n.keyrange.Start + hi
 		}
-		rc.nbytesUsed -= bFreed
+		return out, true
+	case []int:
+		out := make([]int, 0, keyrange.End-keyrange.Start+1)
+		next := keyrange.Start
+		for _, n := range segments {
+			v, ok := n.value.([]int)
+			if !ok {
+				return nil, false
+			}
+			lo, hi, ok := sliceBounds(n.keyrange, next, keyrange.End, len(v))
+			if !ok {
+				return nil, false
+			}
+			out = append(out, v[lo:hi]...)
+			next = n.keyrange.Start + hi
+		}
+		return out, true
+	default:
+		return nil, false
 	}
 }
 
-// BytesUsed returns the number of bytes used in the range cache.
-func (rc *RangeCache) BytesUsed() int64 { return rc.nbytesUsed }
+// sliceBounds computes the [lo:hi) slice of a segment spanning
+// krange's value that covers [next, end], clamped to the segment's own
+// length.
+func sliceBounds(krange Keyrange, next, end, valueLen int) (lo, hi int, ok bool) {
+	lo = next - krange.Start
+	hi = end - krange.Start + 1
+	if hi > valueLen {
+		hi = valueLen
+	}
+	if lo < 0 || lo > hi || lo > valueLen {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
 
-func (rc *RangeCache) liesInRange(keyrange Keyrange) (*list.Element, interface{}, bool) {
-	if rc.rangecache == nil {
-		return nil, nil, false
+// mergeSegments collapses the cache entries used to satisfy a Stitch
+// into a single entry spanning their full union, so that fragmentation
+// from many small overlapping/adjacent ranges doesn't keep growing on
+// every stitched read. A no-op when segments has fewer than two nodes.
+func (rc *RangeCache) mergeSegments(segments []*node) {
+	if len(segments) < 2 {
+		return
+	}
+	span := Keyrange{Start: segments[0].keyrange.Start, End: segments[len(segments)-1].keyrange.End}
+	merged, ok := stitchSegments(segments, span)
+	if !ok {
+		return
 	}
 
-	starts := make(map[int]*list.Element)
-	ends := make(map[int]*list.Element)
+	if !rc.policy.Admit(span, sizeOf(merged)) {
+		return // policy rejected the merged span; leave the smaller segments as-is
+	}
 
-	for kr, e := range rc.rangecache {
-		if kr.Start <= keyrange.Start {
-			starts[kr.Start] = e
-		}
-		if kr.End >= keyrange.End {
-			ends[kr.End] = e
-		}
+	var freed int64
+	for _, n := range segments {
+		rc.tree.delete(n)
+		rc.policy.Remove(n.keyrange)
+		freed += sizeOf(n.value)
 	}
 
-	// log.Printf("keyrange: %v\nstarts: %v\nends: %v\n", keyrange, starts, ends)
-
-	for start := range starts {
-		for end := range ends {
-			if starts[start] == ends[end] { // keyrange is inside cached range.
-				e := rc.rangecache[Keyrange{start, end}]
-				var value interface{}
-				switch e.Value.(*item).value.(type) {
-				case []int:
-					value = e.Value.(*item).value.([]int)[keyrange.Start : keyrange.End+1]
-				case []byte:
-					value = e.Value.(*item).value.([]byte)[keyrange.Start : keyrange.End+1]
-				default:
-					value = e.Value.(*item).value.([]byte)[keyrange.Start : keyrange.End+1]
-				}
-				// log.Printf("slice at [%d:%d] = %v\n\n", keyrange.Start, keyrange.End, value)
-				return e, value, true
-			}
-		}
+	rc.tree.insert(span, merged)
+	rc.nbytesUsed += sizeOf(merged) - freed
+}
+
+// evict asks the eviction policy for its victim and removes it from the
+// cache. It reports whether anything was evicted.
+func (rc *RangeCache) evict() bool {
+	key, ok := rc.policy.Victim()
+	if !ok {
+		return false
 	}
-	return nil, nil, false
+	n := rc.tree.search(key)
+	if n == nil {
+		rc.policy.Remove(key) // stale bookkeeping; nothing to actually evict
+		return false
+	}
+	rc.tree.delete(n)
+	rc.policy.Remove(key)
+	rc.nbytesUsed -= sizeOf(n.value)
+	return true
 }
+
+// BytesUsed returns the number of bytes used in the range cache.
+func (rc *RangeCache) BytesUsed() int64 { return rc.nbytesUsed }
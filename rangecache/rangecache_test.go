@@ -20,7 +20,7 @@ var incomingRanges = []struct {
 		[]bool{true, true, true},
 	},
 	{"exact range match, evict lru keyrange element",
-		8484, // this will evict {0-100}
+		1200, // this will evict {0-100}: (101+26+26) ints * 8 bytes > 1200
 		[]Keyrange{{0, 100}, {50, 75}, {75, 100}},
 		[]Keyrange{{0, 100}, {50, 75}, {75, 100}},
 		[]bool{false, true, true},
@@ -0,0 +1,168 @@
+package rangecache
+
+import "container/list"
+
+// s3fifoQueue identifies which of S3-FIFO's three queues a key is
+// currently tracked in.
+type s3fifoQueue int
+
+const (
+	s3fifoSmall s3fifoQueue = iota
+	s3fifoMain
+	s3fifoGhost
+)
+
+// maxS3FIFOFreq caps the per-key frequency counter S3-FIFO uses to
+// decide whether an entry gets a second chance instead of being
+// evicted. Capping it (rather than letting it grow unbounded) is what
+// keeps a once-popular-now-cold entry from squatting on main forever.
+const maxS3FIFOFreq = 3
+
+// s3FIFOPolicy implements S3-FIFO: three plain FIFO queues (small, main,
+// ghost) stand in for the segmented LRU most caches use, at a fraction
+// of the bookkeeping cost. New keys enter small; a small entry that's
+// been touched survives eviction by moving to main instead, otherwise
+// it's evicted and its key is remembered in ghost. A main entry is only
+// evicted once its frequency counter has decayed to zero, giving it
+// repeated "one more lap" reprieves first. A ghost hit (a key that was
+// evicted but is being requested again) skips back into main directly,
+// since that's strong evidence it didn't deserve eviction.
+type s3FIFOPolicy struct {
+	smallCap int
+	ghostCap int
+
+	small *list.List
+	main  *list.List
+	ghost *list.List
+
+	where map[Keyrange]s3fifoQueue
+	freq  map[Keyrange]int
+	elems map[Keyrange]*list.Element
+}
+
+// NewS3FIFOPolicy creates an S3-FIFO EvictionPolicy sized for roughly
+// capacity distinct resident ranges: small holds about 10% of that
+// capacity (the standard S3-FIFO split) and ghost remembers up to
+// capacity recently evicted keys.
+func NewS3FIFOPolicy(capacity int) EvictionPolicy {
+	smallCap := capacity / 10
+	if smallCap < 1 {
+		smallCap = 1
+	}
+	return &s3FIFOPolicy{
+		smallCap: smallCap,
+		ghostCap: capacity,
+		small:    list.New(),
+		main:     list.New(),
+		ghost:    list.New(),
+		where:    make(map[Keyrange]s3fifoQueue),
+		freq:     make(map[Keyrange]int),
+		elems:    make(map[Keyrange]*list.Element),
+	}
+}
+
+func (p *s3FIFOPolicy) Admit(key Keyrange, cost int64) bool {
+	if p.where[key] == s3fifoGhost {
+		p.removeFromGhost(key)
+		p.where[key] = s3fifoMain
+		p.freq[key] = 1
+		p.elems[key] = p.main.PushBack(key)
+		return true
+	}
+	p.where[key] = s3fifoSmall
+	p.freq[key] = 0
+	p.elems[key] = p.small.PushBack(key)
+	return true
+}
+
+func (p *s3FIFOPolicy) Touch(key Keyrange) {
+	if p.freq[key] < maxS3FIFOFreq {
+		p.freq[key]++
+	}
+}
+
+// Victim runs S3-FIFO's eviction algorithm: prefer evicting from small
+// once it's over quota, giving a touched small entry a promotion to
+// main instead of evicting it outright; otherwise evict from main,
+// giving a still-wanted main entry a frequency-decremented second lap
+// instead. Either path demotes the actual victim's key to ghost.
+func (p *s3FIFOPolicy) Victim() (Keyrange, bool) {
+	for {
+		switch {
+		case p.small.Len() > p.smallCap || (p.small.Len() > 0 && p.main.Len() == 0):
+			key := p.popFront(p.small)
+			if p.freq[key] > 0 {
+				p.where[key] = s3fifoMain
+				p.elems[key] = p.main.PushBack(key)
+				continue
+			}
+			p.evictToGhost(key)
+			return key, true
+		case p.main.Len() > 0:
+			key := p.popFront(p.main)
+			if p.freq[key] > 0 {
+				p.freq[key]--
+				p.where[key] = s3fifoMain
+				p.elems[key] = p.main.PushBack(key)
+				continue
+			}
+			p.evictToGhost(key)
+			return key, true
+		default:
+			return Keyrange{}, false
+		}
+	}
+}
+
+// popFront removes and returns the key at the front of from.
+func (p *s3FIFOPolicy) popFront(from *list.List) Keyrange {
+	e := from.Front()
+	key := e.Value.(Keyrange)
+	from.Remove(e)
+	delete(p.elems, key)
+	return key
+}
+
+func (p *s3FIFOPolicy) evictToGhost(key Keyrange) {
+	delete(p.freq, key)
+	p.where[key] = s3fifoGhost
+	p.elems[key] = p.ghost.PushBack(key)
+	for p.ghost.Len() > p.ghostCap {
+		e := p.ghost.Front()
+		k := e.Value.(Keyrange)
+		p.ghost.Remove(e)
+		delete(p.elems, k)
+		delete(p.where, k)
+	}
+}
+
+func (p *s3FIFOPolicy) removeFromGhost(key Keyrange) {
+	if e, ok := p.elems[key]; ok && p.where[key] == s3fifoGhost {
+		p.ghost.Remove(e)
+		delete(p.elems, key)
+	}
+	delete(p.where, key)
+}
+
+// Remove drops key from whichever of small/main it's tracked in. A key
+// Victim already moved to ghost is left alone: ghost's whole purpose is
+// to survive past the eviction that put it there, so a re-access can
+// still be recognized and promoted straight back into main.
+func (p *s3FIFOPolicy) Remove(key Keyrange) {
+	switch p.where[key] {
+	case s3fifoSmall:
+		if e, ok := p.elems[key]; ok {
+			p.small.Remove(e)
+		}
+		delete(p.where, key)
+		delete(p.freq, key)
+		delete(p.elems, key)
+	case s3fifoMain:
+		if e, ok := p.elems[key]; ok {
+			p.main.Remove(e)
+		}
+		delete(p.where, key)
+		delete(p.freq, key)
+		delete(p.elems, key)
+	}
+}
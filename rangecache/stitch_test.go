@@ -0,0 +1,145 @@
+package rangecache
+
+import "testing"
+
+// TestStitchUnionOfAdjacentRanges checks the motivating case for Stitch,
+// scaled down from the real {0, 12800000} workload: a request should be
+// satisfiable from two prior adjacent fetches without re-downloading.
+func TestStitchUnionOfAdjacentRanges(t *testing.T) {
+	rc := NewRangeCache(64000000)
+
+	first := Keyrange{Start: 0, End: 640}
+	second := Keyrange{Start: 641, End: 1280}
+	rc.Add(first, generateValue(first))
+	rc.Add(second, generateValue(second))
+
+	want := Keyrange{Start: 0, End: 1280}
+	got, ok := rc.Get(want)
+	if !ok {
+		t.Fatalf("Get(%v) = _, false, want a stitched hit", want)
+	}
+
+	value := got.([]int)
+	if len(value) != want.End-want.Start+1 {
+		t.Fatalf("Get(%v) returned %d ints, want %d", want, len(value), want.End-want.Start+1)
+	}
+	for i, v := range value {
+		if v != want.Start+i {
+			t.Fatalf("Get(%v)[%d] = %d, want %d", want, i, v, want.Start+i)
+		}
+	}
+}
+
+// TestStitchOverlappingRanges checks that Stitch correctly offsets each
+// segment when the cached ranges overlap rather than merely touch.
+func TestStitchOverlappingRanges(t *testing.T) {
+	rc := NewRangeCache(64000000)
+
+	first := Keyrange{Start: 0, End: 100}
+	second := Keyrange{Start: 50, End: 150}
+	rc.Add(first, generateValue(first))
+	rc.Add(second, generateValue(second))
+
+	want := Keyrange{Start: 20, End: 130}
+	got, ok := rc.Get(want)
+	if !ok {
+		t.Fatalf("Get(%v) = _, false, want a stitched hit", want)
+	}
+
+	value := got.([]int)
+	if len(value) != want.End-want.Start+1 {
+		t.Fatalf("Get(%v) returned %d ints, want %d", want, len(value), want.End-want.Start+1)
+	}
+	for i, v := range value {
+		if v != want.Start+i {
+			t.Fatalf("Get(%v)[%d] = %d, want %d", want, i, v, want.Start+i)
+		}
+	}
+}
+
+// TestStitchGapNotCovered checks that Stitch refuses to answer from
+// ranges whose union leaves a gap, rather than silently returning
+// incomplete data.
+func TestStitchGapNotCovered(t *testing.T) {
+	rc := NewRangeCache(64000000)
+
+	first := Keyrange{Start: 0, End: 50}
+	second := Keyrange{Start: 60, End: 100}
+	rc.Add(first, generateValue(first))
+	rc.Add(second, generateValue(second))
+
+	if _, ok := rc.Get(Keyrange{Start: 0, End: 100}); ok {
+		t.Fatalf("Get found a hit despite a gap between cached ranges")
+	}
+}
+
+// TestMergeReducesFragmentation checks that a successful Stitch across
+// more than one segment collapses them into a single cache entry.
+func TestMergeReducesFragmentation(t *testing.T) {
+	rc := NewRangeCache(64000000)
+
+	first := Keyrange{Start: 0, End: 640}
+	second := Keyrange{Start: 641, End: 1280}
+	rc.Add(first, generateValue(first))
+	rc.Add(second, generateValue(second))
+
+	if rc.tree.Len() != 2 {
+		t.Fatalf("before Stitch: tree has %d nodes, want 2", rc.tree.Len())
+	}
+
+	if _, ok := rc.Get(Keyrange{Start: 0, End: 1280}); !ok {
+		t.Fatalf("Get did not produce a stitched hit")
+	}
+
+	if rc.tree.Len() != 1 {
+		t.Fatalf("after Stitch: tree has %d nodes, want 1 (segments should be merged)", rc.tree.Len())
+	}
+
+	// The merged entry should itself be an exact hit for the full span.
+	if _, ok := rc.Get(Keyrange{Start: 0, End: 1280}); !ok {
+		t.Fatalf("Get(full span) after merge = _, false, want true (exact hit)")
+	}
+}
+
+// costCapPolicy admits any candidate at or under max, rejects anything
+// larger. Eviction is never exercised by the tests that use it, so
+// Touch/Victim/Remove are no-ops.
+type costCapPolicy struct{ max int64 }
+
+func (p costCapPolicy) Admit(_ Keyrange, cost int64) bool { return cost <= p.max }
+func (costCapPolicy) Touch(Keyrange)                      {}
+func (costCapPolicy) Victim() (Keyrange, bool)            { return Keyrange{}, false }
+func (costCapPolicy) Remove(Keyrange)                     {}
+
+// TestMergeSkippedWhenPolicyRejectsMergedSpan checks that mergeSegments
+// leaves the original segments in place, rather than replacing them
+// with an entry the eviction policy never admitted, when the merged
+// span's cost exceeds what Admit allows even though each individual
+// segment was small enough to be cached on its own.
+func TestMergeSkippedWhenPolicyRejectsMergedSpan(t *testing.T) {
+	rc := NewRangeCache(64000000, WithEvictionPolicy(costCapPolicy{max: 100}))
+
+	first := Keyrange{Start: 0, End: 10}   // 11 ints, 88 bytes: admitted
+	second := Keyrange{Start: 11, End: 20} // 10 ints, 80 bytes: admitted
+	rc.Add(first, generateValue(first))
+	rc.Add(second, generateValue(second))
+
+	if rc.tree.Len() != 2 {
+		t.Fatalf("before Stitch: tree has %d nodes, want 2", rc.tree.Len())
+	}
+
+	want := Keyrange{Start: 0, End: 20} // 21 ints, 168 bytes: over the cap
+	if _, ok := rc.Get(want); !ok {
+		t.Fatalf("Get(%v) = _, false, want a stitched hit", want)
+	}
+
+	if rc.tree.Len() != 2 {
+		t.Fatalf("after rejected merge: tree has %d nodes, want 2 (segments should be left as-is)", rc.tree.Len())
+	}
+	if rc.tree.search(first) == nil {
+		t.Fatalf("after rejected merge: %v is no longer in the tree", first)
+	}
+	if rc.tree.search(second) == nil {
+		t.Fatalf("after rejected merge: %v is no longer in the tree", second)
+	}
+}
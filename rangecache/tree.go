@@ -0,0 +1,374 @@
+package rangecache
+
+// This file implements the augmented red-black interval tree backing
+// RangeCache. It is keyed on (Keyrange.Start, Keyrange.End) and each
+// node additionally stores maxEnd, the largest End in its subtree, so
+// that overlap queries can prune whole subtrees instead of scanning
+// every entry. See CLRS ch.13/14 for the underlying red-black and
+// interval-tree algorithms this adapts.
+//
+// The tree only stores keyrange/value pairs; eviction ordering lives in
+// an EvictionPolicy, not on the node itself.
+
+type color bool
+
+const (
+	red   color = true
+	black color = false
+)
+
+type node struct {
+	keyrange Keyrange
+	value    interface{}
+
+	maxEnd int
+	color  color
+
+	left, right, parent *node
+}
+
+// less orders nodes by (Start, End), so that ranges sharing a Start
+// (e.g. {0,100} and {0,50}) still have a well-defined position.
+func (kr Keyrange) less(other Keyrange) bool {
+	if kr.Start != other.Start {
+		return kr.Start < other.Start
+	}
+	return kr.End < other.End
+}
+
+// tree is a red-black tree of nodes, augmented with maxEnd. It is not
+// safe for concurrent use.
+type tree struct {
+	root *node
+	nilN *node // sentinel: always black, stands in for every nil leaf
+	size int
+}
+
+func newTree() *tree {
+	sentinel := &node{color: black}
+	sentinel.left, sentinel.right, sentinel.parent = sentinel, sentinel, sentinel
+	return &tree{root: sentinel, nilN: sentinel}
+}
+
+func (t *tree) Len() int { return t.size }
+
+// updateMaxEnd recomputes n.maxEnd from its children and End, then
+// propagates up to the root. Called after any structural change
+// (insert, delete) that could invalidate ancestors' maxEnd. It does not
+// stop early on an apparently-unchanged value: delete can relocate a
+// node (its successor) into a new position without updating that node's
+// stored maxEnd first, so an early "unchanged" reading can't be trusted.
+func (t *tree) updateMaxEnd(n *node) {
+	for n != t.nilN {
+		maxEnd := n.keyrange.End
+		if n.left != t.nilN && n.left.maxEnd > maxEnd {
+			maxEnd = n.left.maxEnd
+		}
+		if n.right != t.nilN && n.right.maxEnd > maxEnd {
+			maxEnd = n.right.maxEnd
+		}
+		n.maxEnd = maxEnd
+		n = n.parent
+	}
+}
+
+func (t *tree) rotateLeft(x *node) {
+	y := x.right
+	x.right = y.left
+	if y.left != t.nilN {
+		y.left.parent = x
+	}
+	y.parent = x.parent
+	if x.parent == t.nilN {
+		t.root = y
+	} else if x == x.parent.left {
+		x.parent.left = y
+	} else {
+		x.parent.right = y
+	}
+	y.left = x
+	x.parent = y
+
+	y.maxEnd = x.maxEnd
+	t.recomputeMaxEnd(x)
+}
+
+func (t *tree) rotateRight(x *node) {
+	y := x.left
+	x.left = y.right
+	if y.right != t.nilN {
+		y.right.parent = x
+	}
+	y.parent = x.parent
+	if x.parent == t.nilN {
+		t.root = y
+	} else if x == x.parent.right {
+		x.parent.right = y
+	} else {
+		x.parent.left = y
+	}
+	y.right = x
+	x.parent = y
+
+	y.maxEnd = x.maxEnd
+	t.recomputeMaxEnd(x)
+}
+
+// recomputeMaxEnd recomputes a single node's maxEnd from its current
+// children, without propagating to ancestors (the rotation that called
+// this already arranged for that via y taking x's old maxEnd).
+func (t *tree) recomputeMaxEnd(n *node) {
+	maxEnd := n.keyrange.End
+	if n.left != t.nilN && n.left.maxEnd > maxEnd {
+		maxEnd = n.left.maxEnd
+	}
+	if n.right != t.nilN && n.right.maxEnd > maxEnd {
+		maxEnd = n.right.maxEnd
+	}
+	n.maxEnd = maxEnd
+}
+
+// insert adds keyrange/value as a new node and returns it. Behavior for
+// an exact (Start, End) duplicate is the caller's responsibility to
+// check beforehand via search.
+func (t *tree) insert(keyrange Keyrange, value interface{}) *node {
+	z := &node{keyrange: keyrange, value: value, maxEnd: keyrange.End, color: red}
+	z.left, z.right = t.nilN, t.nilN
+
+	y := t.nilN
+	x := t.root
+	for x != t.nilN {
+		y = x
+		if z.keyrange.less(x.keyrange) {
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	z.parent = y
+	if y == t.nilN {
+		t.root = z
+	} else if z.keyrange.less(y.keyrange) {
+		y.left = z
+	} else {
+		y.right = z
+	}
+
+	t.size++
+	t.updateMaxEnd(z)
+	t.insertFixup(z)
+	return z
+}
+
+func (t *tree) insertFixup(z *node) {
+	for z.parent.color == red {
+		if z.parent == z.parent.parent.left {
+			y := z.parent.parent.right
+			if y.color == red {
+				z.parent.color = black
+				y.color = black
+				z.parent.parent.color = red
+				z = z.parent.parent
+			} else {
+				if z == z.parent.right {
+					z = z.parent
+					t.rotateLeft(z)
+				}
+				z.parent.color = black
+				z.parent.parent.color = red
+				t.rotateRight(z.parent.parent)
+			}
+		} else {
+			y := z.parent.parent.left
+			if y.color == red {
+				z.parent.color = black
+				y.color = black
+				z.parent.parent.color = red
+				z = z.parent.parent
+			} else {
+				if z == z.parent.left {
+					z = z.parent
+					t.rotateRight(z)
+				}
+				z.parent.color = black
+				z.parent.parent.color = red
+				t.rotateLeft(z.parent.parent)
+			}
+		}
+	}
+	t.root.color = black
+}
+
+// search finds the node exactly matching keyrange's (Start, End), or
+// nil if there isn't one.
+func (t *tree) search(keyrange Keyrange) *node {
+	x := t.root
+	for x != t.nilN {
+		if keyrange == x.keyrange {
+			return x
+		}
+		if keyrange.less(x.keyrange) {
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	return nil
+}
+
+// overlapping returns every node whose Keyrange overlaps kr, in O(log n
+// + k) where k is the number of matches: maxEnd lets the search skip
+// any subtree whose largest End still falls before kr.Start.
+func (t *tree) overlapping(kr Keyrange) []*node {
+	var matches []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == t.nilN || n.maxEnd < kr.Start {
+			return
+		}
+		if n.left != t.nilN {
+			walk(n.left)
+		}
+		if n.keyrange.Start <= kr.End && n.keyrange.End >= kr.Start {
+			matches = append(matches, n)
+		}
+		if n.keyrange.Start <= kr.End {
+			walk(n.right)
+		}
+	}
+	walk(t.root)
+	return matches
+}
+
+func (t *tree) minimum(n *node) *node {
+	for n.left != t.nilN {
+		n = n.left
+	}
+	return n
+}
+
+func (t *tree) transplant(u, v *node) {
+	if u.parent == t.nilN {
+		t.root = v
+	} else if u == u.parent.left {
+		u.parent.left = v
+	} else {
+		u.parent.right = v
+	}
+	v.parent = u.parent
+}
+
+// delete removes z from the tree.
+func (t *tree) delete(z *node) {
+	y := z
+	yOriginalColor := y.color
+	var x, xParent *node
+
+	if z.left == t.nilN {
+		x = z.right
+		xParent = z.parent
+		t.transplant(z, z.right)
+	} else if z.right == t.nilN {
+		x = z.left
+		xParent = z.parent
+		t.transplant(z, z.left)
+	} else {
+		y = t.minimum(z.right)
+		yOriginalColor = y.color
+		x = y.right
+		if y.parent == z {
+			xParent = y
+		} else {
+			xParent = y.parent
+			t.transplant(y, y.right)
+			y.right = z.right
+			y.right.parent = y
+		}
+		t.transplant(z, y)
+		y.left = z.left
+		y.left.parent = y
+		y.color = z.color
+	}
+
+	t.size--
+	t.updateMaxEnd(xParent)
+
+	if yOriginalColor == black {
+		t.deleteFixup(x, xParent)
+	}
+}
+
+func (t *tree) deleteFixup(x, xParent *node) {
+	for x != t.root && x.color == black {
+		if x == xParent.left {
+			w := xParent.right
+			if w.color == red {
+				w.color = black
+				xParent.color = red
+				t.rotateLeft(xParent)
+				w = xParent.right
+			}
+			if w.left.color == black && w.right.color == black {
+				w.color = red
+				x = xParent
+				xParent = x.parent
+			} else {
+				if w.right.color == black {
+					w.left.color = black
+					w.color = red
+					t.rotateRight(w)
+					w = xParent.right
+				}
+				w.color = xParent.color
+				xParent.color = black
+				w.right.color = black
+				t.rotateLeft(xParent)
+				x = t.root
+				xParent = x.parent
+			}
+		} else {
+			w := xParent.left
+			if w.color == red {
+				w.color = black
+				xParent.color = red
+				t.rotateRight(xParent)
+				w = xParent.left
+			}
+			if w.right.color == black && w.left.color == black {
+				w.color = red
+				x = xParent
+				xParent = x.parent
+			} else {
+				if w.left.color == black {
+					w.right.color = black
+					w.color = red
+					t.rotateLeft(w)
+					w = xParent.left
+				}
+				w.color = xParent.color
+				xParent.color = black
+				w.left.color = black
+				t.rotateRight(xParent)
+				x = t.root
+				xParent = x.parent
+			}
+		}
+	}
+	x.color = black
+}
+
+// inorder returns every node in ascending (Start, End) order.
+func (t *tree) inorder() []*node {
+	var nodes []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n == t.nilN {
+			return
+		}
+		walk(n.left)
+		nodes = append(nodes, n)
+		walk(n.right)
+	}
+	walk(t.root)
+	return nodes
+}
@@ -0,0 +1,92 @@
+package rangecache
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTreeSearchExact(t *testing.T) {
+	tr := newTree()
+	ranges := []Keyrange{{0, 100}, {50, 75}, {75, 100}, {200, 300}}
+	for _, kr := range ranges {
+		n := tr.insert(kr, nil)
+		if n.keyrange != kr {
+			t.Fatalf("insert(%v) node keyrange = %v", kr, n.keyrange)
+		}
+	}
+
+	for _, kr := range ranges {
+		if n := tr.search(kr); n == nil || n.keyrange != kr {
+			t.Fatalf("search(%v) = %v, want a node with that keyrange", kr, n)
+		}
+	}
+	if n := tr.search(Keyrange{0, 99}); n != nil {
+		t.Fatalf("search(0,99) = %v, want nil (no exact match)", n)
+	}
+}
+
+func TestTreeOverlapping(t *testing.T) {
+	tr := newTree()
+	for _, kr := range []Keyrange{{0, 10}, {20, 30}, {5, 25}, {100, 110}} {
+		tr.insert(kr, nil)
+	}
+
+	got := tr.overlapping(Keyrange{8, 22})
+	want := map[Keyrange]bool{{0, 10}: true, {20, 30}: true, {5, 25}: true}
+	if len(got) != len(want) {
+		t.Fatalf("overlapping(8,22) returned %d nodes, want %d", len(got), len(want))
+	}
+	for _, n := range got {
+		if !want[n.keyrange] {
+			t.Fatalf("overlapping(8,22) returned unexpected range %v", n.keyrange)
+		}
+	}
+
+	if got := tr.overlapping(Keyrange{200, 210}); len(got) != 0 {
+		t.Fatalf("overlapping(200,210) = %v, want none", got)
+	}
+}
+
+// TestTreeMaxEndInvariant inserts and deletes a large randomized set of
+// ranges and checks, after every mutation, that every node's maxEnd
+// equals the true maximum End in its subtree - the invariant overlap
+// queries depend on to safely prune subtrees.
+func TestTreeMaxEndInvariant(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tr := newTree()
+	var nodes []*node
+
+	for i := 0; i < 500; i++ {
+		start := rng.Intn(1000)
+		kr := Keyrange{Start: start, End: start + rng.Intn(50)}
+		nodes = append(nodes, tr.insert(kr, nil))
+		checkMaxEndInvariant(t, tr, tr.root)
+	}
+
+	rng.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	for _, n := range nodes {
+		tr.delete(n)
+		checkMaxEndInvariant(t, tr, tr.root)
+	}
+	if tr.Len() != 0 {
+		t.Fatalf("after deleting everything, tree.Len() = %d, want 0", tr.Len())
+	}
+}
+
+func checkMaxEndInvariant(t *testing.T, tr *tree, n *node) int {
+	t.Helper()
+	if n == tr.nilN {
+		return -1 << 62
+	}
+	maxEnd := n.keyrange.End
+	if l := checkMaxEndInvariant(t, tr, n.left); l > maxEnd {
+		maxEnd = l
+	}
+	if r := checkMaxEndInvariant(t, tr, n.right); r > maxEnd {
+		maxEnd = r
+	}
+	if n.maxEnd != maxEnd {
+		t.Fatalf("node %v: maxEnd = %d, want %d", n.keyrange, n.maxEnd, maxEnd)
+	}
+	return maxEnd
+}
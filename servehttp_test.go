@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// rangeOrigin is a minimal HTTP byte-range origin for ServeHTTP tests:
+// it always serves the requested Range out of body.
+func rangeOrigin(t *testing.T, body []byte) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if rng == "" { // HEAD probe: report the full length
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if end >= len(body) {
+			end = len(body) - 1
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body[start : end+1])
+	}))
+}
+
+func TestServeHTTPMissingURLParam(t *testing.T) {
+	cs := NewCacheServer(nbytesMax)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?start=0&end=10", nil)
+
+	cs.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeHTTPDisallowedOrigin(t *testing.T) {
+	cs := NewCacheServer(nbytesMax)
+	registry := NewOriginRegistry()
+	registry.Allow("https://allowed.example/", 0)
+	cs.SetOrigins(registry)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?url="+url.QueryEscape("https://evil.example/a.mp4")+"&start=0&end=10", nil)
+
+	cs.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeHTTPOutOfRange(t *testing.T) {
+	origin := rangeOrigin(t, []byte("hello world"))
+	defer origin.Close()
+
+	cs := NewCacheServer(nbytesMax)
+	registry := NewOriginRegistry()
+	registry.Allow(origin.URL, 0)
+	cs.SetOrigins(registry)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL)+"&start=1000&end=2000", nil)
+
+	cs.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+}
+
+func TestServeHTTPServesRangeWithHeaders(t *testing.T) {
+	origin := rangeOrigin(t, []byte("hello world"))
+	defer origin.Close()
+
+	cs := NewCacheServer(nbytesMax)
+	registry := NewOriginRegistry()
+	registry.Allow(origin.URL, 0)
+	cs.SetOrigins(registry)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL)+"&start=0&end=4", nil)
+
+	cs.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	if got, want := w.Body.String(), "hello"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Accept-Ranges = %q, want %q", w.Header().Get("Accept-Ranges"), "bytes")
+	}
+	if w.Header().Get("Content-Range") != "bytes 0-4/11" {
+		t.Fatalf("Content-Range = %q, want %q", w.Header().Get("Content-Range"), "bytes 0-4/11")
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("ETag header is empty, want a derived ETag")
+	}
+
+	// A second request with If-None-Match set to that ETag should get a
+	// 304 without re-fetching from the origin.
+	w2 := httptest.NewRecorder()
+	r2 := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL)+"&start=0&end=4", nil)
+	r2.Header.Set("If-None-Match", etag)
+
+	cs.ServeHTTP(w2, r2)
+
+	if w2.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", w2.Code, http.StatusNotModified)
+	}
+}
+
+// TestServeHTTPDistinctOriginsDoNotCollide checks that two different
+// allowed origins serving the identical numeric byte range each get
+// served their own bytes: the cache key must include the source URL,
+// not just the range.
+func TestServeHTTPDistinctOriginsDoNotCollide(t *testing.T) {
+	originA := rangeOrigin(t, []byte("from origin A"))
+	defer originA.Close()
+	originB := rangeOrigin(t, []byte("from origin B"))
+	defer originB.Close()
+
+	cs := NewCacheServer(nbytesMax)
+	registry := NewOriginRegistry()
+	registry.Allow(originA.URL, 0)
+	registry.Allow(originB.URL, 0)
+	cs.SetOrigins(registry)
+
+	get := func(originURL string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?url="+url.QueryEscape(originURL)+"&start=0&end=12", nil)
+		cs.ServeHTTP(w, r)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("ServeHTTP(%s) status = %d, want %d", originURL, w.Code, http.StatusPartialContent)
+		}
+		return w.Body.String()
+	}
+
+	// Warm origin A's cache entry for {0,12} first, then request the
+	// same numeric range from origin B: it must not come back as
+	// origin A's cached bytes.
+	if got, want := get(originA.URL), "from origin A"; got != want {
+		t.Fatalf("origin A body = %q, want %q", got, want)
+	}
+	if got, want := get(originB.URL), "from origin B"; got != want {
+		t.Fatalf("origin B body = %q, want %q", got, want)
+	}
+	// Repeating origin A's request should still return origin A's
+	// bytes from cache.
+	if got, want := get(originA.URL), "from origin A"; got != want {
+		t.Fatalf("origin A body (cached) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/zeneli/cacheserver/rangecache"
+)
+
+// chunkSize is the size of the fixed sub-chunks a range is split into
+// for streaming: small enough to bound time-to-first-byte to a single
+// sub-chunk fetch rather than the whole range, large enough to keep
+// per-chunk overhead low.
+const chunkSize = 256 * 1024 // 256 KB
+
+// subchunks splits keyrange into the sequence of chunkSize-aligned
+// sub-ranges that cover it. Sub-chunk boundaries are anchored to
+// absolute offsets (chunk index = offset / chunkSize), not to
+// keyrange.Start, so that two overlapping requests decompose into the
+// same sub-chunks and therefore hit the same cache entries and the same
+// duplicate-suppression key.
+func subchunks(keyrange rangecache.Keyrange) []rangecache.Keyrange {
+	var chunks []rangecache.Keyrange
+	first := (keyrange.Start / chunkSize) * chunkSize
+	for start := first; start <= keyrange.End; start += chunkSize {
+		chunks = append(chunks, rangecache.Keyrange{Start: start, End: start + chunkSize - 1})
+	}
+	return chunks
+}
+
+// GetRangeStream returns keyrange's bytes as a stream. Internally it
+// fetches keyrange's sub-chunks one at a time via GetRangeDupSup, so
+// each sub-chunk is cached independently and a second caller for an
+// overlapping range shares the same in-flight sub-chunk fetches instead
+// of waiting on this caller's entire range to finish.
+func (cs *CacheServer) GetRangeStream(url string, keyrange rangecache.Keyrange) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, sub := range subchunks(keyrange) {
+			body, ok := cs.GetRangeDupSup(url, sub, nil)
+			if !ok {
+				pw.CloseWithError(fmt.Errorf("failed to fetch sub-chunk %v", sub))
+				return
+			}
+
+			// Trim the first and last sub-chunk down to the bytes the
+			// caller actually asked for; interior sub-chunks are used
+			// whole. hi starts at len(body) rather than the nominal
+			// chunkSize because a real origin clamps a Range response
+			// to its actual content length: the last sub-chunk of
+			// almost every request, and every sub-chunk of a body
+			// smaller than one chunk, comes back short.
+			lo, hi := 0, len(body)
+			if sub.Start < keyrange.Start {
+				lo = keyrange.Start - sub.Start
+			}
+			if want := keyrange.End - sub.Start + 1; want < hi {
+				hi = want
+			}
+			if lo > hi {
+				pw.CloseWithError(fmt.Errorf("short sub-chunk %v: got %d bytes", sub, len(body)))
+				return
+			}
+
+			if _, err := pw.Write(body[lo:hi]); err != nil {
+				return // reader went away
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// flushWriter flushes after every Write when the underlying
+// http.ResponseWriter supports it, so a client sees bytes as soon as
+// they're written rather than after the handler returns.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// ServeRangeStream is a streaming-aware counterpart to
+// CacheServer.ServeHTTP: it sets Content-Range/Content-Length up front,
+// then copies the body to the client in chunkSize chunks as each
+// sub-chunk becomes available instead of buffering the whole range.
+func (cs *CacheServer) ServeRangeStream(w http.ResponseWriter, r *http.Request) {
+	cs.mu.Lock()
+	origins := cs.origins
+	cs.mu.Unlock()
+
+	sourceURL, start, end, err := processRequiredQueryParams(r.URL.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if origins == nil || !origins.Validate(sourceURL) {
+		http.Error(w, fmt.Sprintf("url %q is not an allowed origin", sourceURL), http.StatusBadRequest)
+		return
+	}
+
+	contentLength, rangesOK, err := origins.Probe(sourceURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("probing %s: %v", sourceURL, err), http.StatusBadGateway)
+		return
+	}
+	if !rangesOK {
+		http.Error(w, fmt.Sprintf("%s does not support HTTP byte ranges", sourceURL), http.StatusBadGateway)
+		return
+	}
+	if start >= contentLength {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentLength))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if end > contentLength-1 { // clamp to the last valid byte offset
+		end = contentLength - 1
+	}
+	keyrange := rangecache.Keyrange{Start: int(start), End: int(end)}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", keyrange.Start, keyrange.End, contentLength))
+	w.Header().Set("Content-Length", strconv.Itoa(keyrange.End-keyrange.Start+1))
+	w.Header().Set("ETag", rangeETag(sourceURL, keyrange))
+	w.WriteHeader(http.StatusPartialContent)
+
+	body := cs.GetRangeStream(sourceURL, keyrange)
+	defer body.Close()
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, chunkSize)
+	if _, err := io.CopyBuffer(flushWriter{w, flusher}, body, buf); err != nil {
+		log.Printf("ServeRangeStream: %s: %v", r.URL, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zeneli/cacheserver/rangecache"
+)
+
+func TestSubchunks(t *testing.T) {
+	tests := []struct {
+		description string
+		keyrange    rangecache.Keyrange
+		want        []rangecache.Keyrange
+	}{
+		{"within one chunk", rangecache.Keyrange{Start: 10, End: 20},
+			[]rangecache.Keyrange{{Start: 0, End: chunkSize - 1}}},
+		{"spans two chunks", rangecache.Keyrange{Start: chunkSize - 10, End: chunkSize + 10},
+			[]rangecache.Keyrange{{Start: 0, End: chunkSize - 1}, {Start: chunkSize, End: 2*chunkSize - 1}}},
+		{"starts mid-chunk, ends mid-next", rangecache.Keyrange{Start: chunkSize / 2, End: chunkSize + chunkSize/2},
+			[]rangecache.Keyrange{{Start: 0, End: chunkSize - 1}, {Start: chunkSize, End: 2*chunkSize - 1}}},
+	}
+
+	for _, tt := range tests {
+		got := subchunks(tt.keyrange)
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: subchunks(%v) = %v, want %v", tt.description, tt.keyrange, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: subchunks(%v)[%d] = %v, want %v", tt.description, tt.keyrange, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+// TestGetRangeStreamFromCache exercises GetRangeStream entirely against
+// pre-warmed cache entries, so it doesn't depend on the network.
+func TestGetRangeStreamFromCache(t *testing.T) {
+	cs := NewCacheServer(nbytesMax)
+	const url = "http://example.com/video.mp4"
+
+	full := make([]byte, chunkSize+100)
+	for i := range full {
+		full[i] = byte(i)
+	}
+	cs.add(url, rangecache.Keyrange{Start: 0, End: chunkSize - 1}, full[:chunkSize])
+	cs.add(url, rangecache.Keyrange{Start: chunkSize, End: 2*chunkSize - 1}, append(full[chunkSize:], make([]byte, chunkSize-100)...))
+
+	kr := rangecache.Keyrange{Start: 50, End: chunkSize + 20}
+	r := cs.GetRangeStream(url, kr)
+	defer r.Close()
+
+	got := make([]byte, 0, kr.End-kr.Start+1)
+	buf := make([]byte, 37) // deliberately small to force multiple Reads
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+
+	want := full[kr.Start : kr.End+1]
+	if len(got) != len(want) {
+		t.Fatalf("GetRangeStream(%v) returned %d bytes, want %d", kr, len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("GetRangeStream(%v)[%d] = %d, want %d", kr, i, got[i], want[i])
+		}
+	}
+}
+
+// TestServeRangeStreamShortBody exercises the realistic case a real
+// origin always hits: its Range response is clamped to the body's
+// actual length, so the last (or only) sub-chunk comes back shorter
+// than chunkSize. Previously this tripped the "short sub-chunk" guard
+// and aborted the whole response.
+func TestServeRangeStreamShortBody(t *testing.T) {
+	body := []byte("hello world") // 11 bytes, far short of one chunk
+	origin := rangeOrigin(t, body)
+	defer origin.Close()
+
+	cs := NewCacheServer(nbytesMax)
+	registry := NewOriginRegistry()
+	registry.Allow(origin.URL, 0)
+	cs.SetOrigins(registry)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL)+"&start=0&end=10", nil)
+
+	cs.ServeRangeStream(w, r)
+
+	if w.Code != 206 {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	got, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	if string(got) != string(body) {
+		t.Fatalf("ServeRangeStream body = %q, want %q", got, body)
+	}
+}